@@ -0,0 +1,774 @@
+/**
+ * @brief Built-in authentication filters - Basic, API key and JWT
+ *
+ * @file auth.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Authentication types
+const (
+	AUTH_NONE   = 0
+	AUTH_BASIC  = 1 //HTTP Basic, htpasswd file
+	AUTH_APIKEY = 2 //API key in header, key file
+	AUTH_JWT    = 3 //Bearer JWT, local JWKS file
+)
+
+//Defaults
+const (
+	AUTH_REALM_DEFAULT      = "restincl"
+	APIKEY_HEADER_DEFAULT   = "X-API-Key"
+	JSON_AUTH_FIELD_DEFAULT = "Auth" //JSON key for authenticated principal
+	APR1_MAGIC              = "$apr1$"
+	APR1_ITOA64             = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	SHA_PREFIX              = "{SHA}"
+)
+
+var M_auths = map[string]int{
+	"":       AUTH_NONE,
+	"basic":  AUTH_BASIC,
+	"apikey": AUTH_APIKEY,
+	"jwt":    AUTH_JWT,
+}
+
+//Authenticated principal fields, set only by restincl
+var M_authFlds = []int{ubftab.EX_IF_AUTHUSER, ubftab.EX_IF_AUTHCLAIMS}
+
+//Context key for authentication info in the request
+type authCtxKey struct{}
+
+//Authenticated principal of the request
+type AuthInfo struct {
+	User   string                 `json:"User"`             //User, key name or JWT subject
+	Claims map[string]interface{} `json:"Claims,omitempty"` //Validated JWT claims
+}
+
+//JWT verification key (from JWKS)
+type jwtKey struct {
+	kid    string
+	alg    string
+	secret []byte         //HS256 key (kty oct)
+	rsa    *rsa.PublicKey //RS256 key (kty RSA)
+}
+
+//Credentials loaded for the route
+type AuthDB struct {
+	users map[string]string //Basic: user -> password hash
+	keys  map[string]string //API key: sha256 of key (hex) -> key name
+	jwks  []jwtKey          //JWT verification keys
+}
+
+//Authentication failure
+type authError struct {
+	status int    //HTTP status 401 or 403
+	msg    string //Reason
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+//Read non empty, non comment lines of the file
+//@param fname file name
+//@return lines, error
+func readAuthLines(fname string) ([]string, error) {
+
+	var lines []string
+
+	f, err := os.Open(fname)
+
+	if nil != err {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+//Load htpasswd style file (user:hash), supported hashes: $apr1$, {SHA}, plain
+//@param db auth db to fill
+//@param fname file name
+//@return error or nil
+func loadHtpasswd(db *AuthDB, fname string) error {
+
+	lines, err := readAuthLines(fname)
+
+	if nil != err {
+		return err
+	}
+
+	db.users = make(map[string]string)
+
+	for _, line := range lines {
+
+		i := strings.Index(line, ":")
+
+		if i < 1 {
+			return fmt.Errorf("Invalid htpasswd line [%s]", line)
+		}
+
+		hash := line[i+1:]
+
+		if strings.HasPrefix(hash, "$") && !strings.HasPrefix(hash, APR1_MAGIC) {
+			return fmt.Errorf("Unsupported hash for user [%s], "+
+				"expected $apr1$, {SHA} or plain", line[:i])
+		}
+
+		db.users[line[:i]] = hash
+	}
+
+	return nil
+}
+
+//Load API key file (name:key)
+//@param db auth db to fill
+//@param fname file name
+//@return error or nil
+func loadAPIKeys(db *AuthDB, fname string) error {
+
+	lines, err := readAuthLines(fname)
+
+	if nil != err {
+		return err
+	}
+
+	db.keys = make(map[string]string)
+
+	for _, line := range lines {
+
+		i := strings.Index(line, ":")
+
+		if i < 1 || i == len(line)-1 {
+			return fmt.Errorf("Invalid API key line, expected name:key")
+		}
+
+		sum := sha256.Sum256([]byte(line[i+1:]))
+		db.keys[hex.EncodeToString(sum[:])] = line[:i]
+	}
+
+	return nil
+}
+
+//Load local JWKS file, supported keys: kty RSA (RS256) and kty oct (HS256)
+//@param db auth db to fill
+//@param fname file name
+//@return error or nil
+func loadJWKS(db *AuthDB, fname string) error {
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	data, err := ioutil.ReadFile(fname)
+
+	if nil != err {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &jwks); nil != err {
+		return fmt.Errorf("Failed to parse JWKS: %s", err)
+	}
+
+	for _, k := range jwks.Keys {
+
+		key := jwtKey{kid: k.Kid, alg: k.Alg}
+
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+
+			if nil != errN || nil != errE || len(e) == 0 {
+				return fmt.Errorf("Invalid RSA key [%s] in JWKS", k.Kid)
+			}
+
+			key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64())}
+
+			if "" == key.alg {
+				key.alg = "RS256"
+			}
+			break
+		case "oct":
+			if key.secret, err = base64.RawURLEncoding.DecodeString(k.K); nil != err ||
+				len(key.secret) == 0 {
+				return fmt.Errorf("Invalid oct key [%s] in JWKS", k.Kid)
+			}
+
+			if "" == key.alg {
+				key.alg = "HS256"
+			}
+			break
+		default:
+			return fmt.Errorf("Unsupported key type [%s] in JWKS", k.Kty)
+		}
+
+		if "RS256" != key.alg && "HS256" != key.alg {
+			return fmt.Errorf("Unsupported alg [%s] for key [%s] in JWKS",
+				key.alg, k.Kid)
+		}
+
+		db.jwks = append(db.jwks, key)
+	}
+
+	if len(db.jwks) == 0 {
+		return errors.New("No keys in JWKS")
+	}
+
+	return nil
+}
+
+//Validate auth settings of the route and load the credentials
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initAuth(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	var ok bool
+	var err error
+
+	if svc.Auth_int, ok = M_auths[svc.Auth]; !ok {
+		ac.TpLogError("Route [%s]: unsupported auth [%s], expected basic, "+
+			"apikey or jwt", svc.Url, svc.Auth)
+		return fmt.Errorf("Unsupported auth [%s]", svc.Auth)
+	}
+
+	if AUTH_NONE == svc.Auth_int {
+		return nil
+	}
+
+	if "" == svc.Auth_realm {
+		svc.Auth_realm = AUTH_REALM_DEFAULT
+	}
+
+	if "" == svc.Apikey_header {
+		svc.Apikey_header = APIKEY_HEADER_DEFAULT
+	}
+
+	svc.Authdb = &AuthDB{}
+
+	switch svc.Auth_int {
+	case AUTH_BASIC:
+		err = loadHtpasswd(svc.Authdb, svc.Auth_file)
+		break
+	case AUTH_APIKEY:
+		err = loadAPIKeys(svc.Authdb, svc.Auth_file)
+		break
+	case AUTH_JWT:
+		err = loadJWKS(svc.Authdb, svc.Jwt_jwks)
+		break
+	}
+
+	if nil != err {
+		ac.TpLogError("Route [%s]: failed to load %s credentials: %s",
+			svc.Url, svc.Auth, err)
+		return fmt.Errorf("Route [%s]: failed to load %s credentials: %s",
+			svc.Url, svc.Auth, err)
+	}
+
+	ac.TpLogInfo("Route [%s]: auth %s, users: %d keys: %d jwks: %d allow: %v",
+		svc.Url, svc.Auth, len(svc.Authdb.users), len(svc.Authdb.keys),
+		len(svc.Authdb.jwks), svc.Auth_allow)
+
+	return nil
+}
+
+//Apache MD5 ($apr1$) password hash
+//@param pw password
+//@param salt salt
+//@return hash string in $apr1$salt$hash form
+func apr1(pw, salt string) string {
+
+	ctx := md5.New()
+	ctx.Write([]byte(pw + APR1_MAGIC + salt))
+
+	alt := md5.Sum([]byte(pw + salt + pw))
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+
+	for i := len(pw); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte(pw[:1]))
+		}
+	}
+
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+
+		if i&1 != 0 {
+			c.Write([]byte(pw))
+		} else {
+			c.Write(final)
+		}
+
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			c.Write([]byte(pw))
+		}
+
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write([]byte(pw))
+		}
+
+		final = c.Sum(nil)
+	}
+
+	var out []byte
+
+	enc := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, APR1_ITOA64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	enc(uint(final[0])<<16|uint(final[6])<<8|uint(final[12]), 4)
+	enc(uint(final[1])<<16|uint(final[7])<<8|uint(final[13]), 4)
+	enc(uint(final[2])<<16|uint(final[8])<<8|uint(final[14]), 4)
+	enc(uint(final[3])<<16|uint(final[9])<<8|uint(final[15]), 4)
+	enc(uint(final[4])<<16|uint(final[10])<<8|uint(final[5]), 4)
+	enc(uint(final[11]), 2)
+
+	return APR1_MAGIC + salt + "$" + string(out)
+}
+
+//Check the password against htpasswd hash
+//@param hash hash from file
+//@param pw password given
+//@return true if matches
+func checkPassword(hash, pw string) bool {
+
+	var calc string
+
+	if strings.HasPrefix(hash, APR1_MAGIC) {
+		salt := strings.TrimPrefix(hash, APR1_MAGIC)
+
+		if i := strings.Index(salt, "$"); i > -1 {
+			salt = salt[:i]
+		}
+
+		calc = apr1(pw, salt)
+
+	} else if strings.HasPrefix(hash, SHA_PREFIX) {
+		sum := sha1.Sum([]byte(pw))
+		calc = SHA_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		calc = pw
+	}
+
+	return 1 == subtle.ConstantTimeCompare([]byte(hash), []byte(calc))
+}
+
+//Authenticate by HTTP Basic
+func authBasic(svc *ServiceMap, req *http.Request) (*AuthInfo, error) {
+
+	user, pw, ok := req.BasicAuth()
+
+	if !ok {
+		return nil, &authError{http.StatusUnauthorized, "Missing basic credentials"}
+	}
+
+	hash, found := svc.Authdb.users[user]
+
+	if !found || !checkPassword(hash, pw) {
+		return nil, &authError{http.StatusUnauthorized, "Invalid user or password"}
+	}
+
+	return &AuthInfo{User: user}, nil
+}
+
+//Authenticate by API key header
+func authAPIKey(svc *ServiceMap, req *http.Request) (*AuthInfo, error) {
+
+	key := req.Header.Get(svc.Apikey_header)
+
+	if "" == key {
+		return nil, &authError{http.StatusUnauthorized, "Missing API key"}
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	name, found := svc.Authdb.keys[hex.EncodeToString(sum[:])]
+
+	if !found {
+		return nil, &authError{http.StatusUnauthorized, "Invalid API key"}
+	}
+
+	return &AuthInfo{User: name}, nil
+}
+
+//Get numeric date claim (exp, nbf)
+//@return value, true if claim present and valid
+func jwtDate(claims map[string]interface{}, name string) (int64, bool, error) {
+
+	v, present := claims[name]
+
+	if !present {
+		return 0, false, nil
+	}
+
+	num, ok := v.(json.Number)
+
+	if !ok {
+		return 0, true, fmt.Errorf("Invalid %s claim", name)
+	}
+
+	f, err := num.Float64()
+
+	if nil != err {
+		return 0, true, fmt.Errorf("Invalid %s claim", name)
+	}
+
+	return int64(f), true, nil
+}
+
+//Check audience claim (string or array) contains the audience
+func jwtHasAudience(claims map[string]interface{}, aud string) bool {
+
+	switch v := claims["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Verify JWT signature with the JWKS keys
+func jwtVerify(db *AuthDB, alg, kid string, signed, sig []byte) bool {
+
+	for _, key := range db.jwks {
+
+		//Key shall match the algorithm (no alg confusion) and kid if given
+		if key.alg != alg || ("" != kid && key.kid != kid) {
+			continue
+		}
+
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, key.secret)
+			mac.Write(signed)
+
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+			break
+		case "RS256":
+			sum := sha256.Sum256(signed)
+
+			if nil == rsa.VerifyPKCS1v15(key.rsa, crypto.SHA256, sum[:], sig) {
+				return true
+			}
+			break
+		}
+	}
+
+	return false
+}
+
+//Authenticate by Bearer JWT
+func authJWT(svc *ServiceMap, req *http.Request) (*AuthInfo, error) {
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims map[string]interface{}
+
+	authz := req.Header.Get("Authorization")
+
+	if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+		return nil, &authError{http.StatusUnauthorized, "Missing bearer token"}
+	}
+
+	parts := strings.Split(strings.TrimSpace(authz[7:]), ".")
+
+	if len(parts) != 3 {
+		return nil, &authError{http.StatusUnauthorized, "Malformed token"}
+	}
+
+	hdrb, errH := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, errP := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, errS := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if nil != errH || nil != errP || nil != errS ||
+		nil != json.Unmarshal(hdrb, &hdr) {
+		return nil, &authError{http.StatusUnauthorized, "Malformed token"}
+	}
+
+	if "HS256" != hdr.Alg && "RS256" != hdr.Alg {
+		return nil, &authError{http.StatusUnauthorized,
+			fmt.Sprintf("Unsupported token alg [%s]", hdr.Alg)}
+	}
+
+	if !jwtVerify(svc.Authdb, hdr.Alg, hdr.Kid,
+		[]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, &authError{http.StatusUnauthorized, "Invalid token signature"}
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&claims); nil != err {
+		return nil, &authError{http.StatusUnauthorized, "Malformed token claims"}
+	}
+
+	now := time.Now().Unix()
+
+	if exp, present, err := jwtDate(claims, "exp"); nil != err || present && now >= exp {
+		return nil, &authError{http.StatusUnauthorized, "Token expired"}
+	}
+
+	if nbf, present, err := jwtDate(claims, "nbf"); nil != err || present && now < nbf {
+		return nil, &authError{http.StatusUnauthorized, "Token not yet valid"}
+	}
+
+	if "" != svc.Jwt_aud && !jwtHasAudience(claims, svc.Jwt_aud) {
+		return nil, &authError{http.StatusForbidden, "Token audience mismatch"}
+	}
+
+	sub, _ := claims["sub"].(string)
+
+	return &AuthInfo{User: sub, Claims: claims}, nil
+}
+
+//Authenticate the request according to route settings
+//@param svc service map
+//@param req HTTP request
+//@return auth info (nil if route has no auth) or error
+func authenticate(svc *ServiceMap, req *http.Request) (*AuthInfo, error) {
+
+	var info *AuthInfo
+	var err error
+
+	switch svc.Auth_int {
+	case AUTH_BASIC:
+		info, err = authBasic(svc, req)
+		break
+	case AUTH_APIKEY:
+		info, err = authAPIKey(svc, req)
+		break
+	case AUTH_JWT:
+		info, err = authJWT(svc, req)
+		break
+	default:
+		return nil, nil
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	//Check the principal is allowed
+	if len(svc.Auth_allow) > 0 {
+
+		allowed := false
+
+		for _, user := range svc.Auth_allow {
+			if user == info.User {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return nil, &authError{http.StatusForbidden,
+				fmt.Sprintf("User [%s] not allowed", info.User)}
+		}
+	}
+
+	return info, nil
+}
+
+//Authenticate the request before dispatch to XATMI, on failure 401/403
+//response is generated
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return request (with auth info in context) and true if may continue
+func authFilter(w http.ResponseWriter, req *http.Request,
+	svc *ServiceMap) (*http.Request, bool) {
+
+	info, err := authenticate(svc, req)
+
+	if nil != err {
+		aerr := err.(*authError)
+
+		M_ac.TpLogWarn("URL [%s] auth %s failed: %s", req.URL, svc.Auth, aerr.msg)
+
+		if http.StatusUnauthorized == aerr.status {
+			switch svc.Auth_int {
+			case AUTH_BASIC:
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf("Basic realm=\"%s\"", svc.Auth_realm))
+				break
+			case AUTH_JWT:
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf("Bearer realm=\"%s\", error=\"invalid_token\"",
+						svc.Auth_realm))
+				break
+			}
+		}
+
+		genHTTPErrRsp(M_ac, svc, w, aerr.status,
+			atmi.NewCustomATMIError(atmi.TPEPERM, aerr.msg))
+
+		return req, false
+	}
+
+	if nil != info {
+		M_ac.TpLogInfo("URL [%s] authenticated as [%s]", req.URL, info.User)
+		req = req.WithContext(context.WithValue(req.Context(), authCtxKey{}, info))
+	}
+
+	return req, true
+}
+
+//Get authentication info of the request
+//@param req HTTP request
+//@return auth info or nil if route has no auth
+func requestAuth(req *http.Request) *AuthInfo {
+	info, _ := req.Context().Value(authCtxKey{}).(*AuthInfo)
+	return info
+}
+
+//JSON key of authenticated principal
+//@param svc service map
+//@return key name
+func jsonAuthKey(svc *ServiceMap) string {
+
+	if "" != svc.JsonAuthField {
+		return svc.JsonAuthField
+	}
+
+	return JSON_AUTH_FIELD_DEFAULT
+}
+
+//Load authenticated principal into UBF buffer
+//EX_IF_AUTHUSER and EX_IF_AUTHCLAIMS (JWT claims as JSON)
+//Fields sent by the client are removed, so that principal cannot be forged
+//@param ac ATMI Context
+//@param req HTTP request
+//@param bufu UBF buffer
+//@return UBF error or nil
+func loadAuthUBF(ac *atmi.ATMICtx, req *http.Request,
+	bufu *atmi.TypedUBF) atmi.UBFError {
+
+	if errU := bufu.BDelete(M_authFlds); nil != errU &&
+		atmi.BNOTPRES != errU.Code() {
+		return errU
+	}
+
+	info := requestAuth(req)
+
+	if nil == info {
+		return nil
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_AUTHUSER, 0, info.User); nil != errU {
+		return errU
+	}
+
+	if nil != info.Claims {
+		claims, _ := json.Marshal(info.Claims)
+
+		if errU := bufu.BChg(ubftab.EX_IF_AUTHCLAIMS, 0, string(claims)); nil != errU {
+			return errU
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
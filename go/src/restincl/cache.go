@@ -0,0 +1,475 @@
+/**
+ * @brief Response cache of GET routes, ETag validation
+ *
+ * @file cache.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	CACHE_MAX_DEFAULT = 1000 //Max responses cached
+)
+
+//Cached response
+type cacheEntry struct {
+	key     string
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time
+	expires time.Time
+	elem    *list.Element
+}
+
+//Response cache, least recently used entries are evicted
+var M_cache = struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List
+}{entries: make(map[string]*cacheEntry), lru: list.New()}
+
+var M_cache_max int = CACHE_MAX_DEFAULT //Max responses cached
+
+//Request headers in the key, if cache_headers is not set. Service or
+//filters may authenticate by session cookie or Authorization header,
+//thus responses are not shared between such clients
+var M_cacheHeadersDefault = []string{"Authorization", "Cookie"}
+
+//Request fields not part of converted request in the key, as
+//query and headers are taken by cache_query and cache_headers
+var M_cacheSkipFields = []string{"EX_IF_REQHN", "EX_IF_REQHV", "EX_IF_REQCN",
+	"EX_IF_REQCV", "EX_IF_REQQUERYN", "EX_IF_REQQUERYV", "EX_NREQLOGFILE"}
+
+//Response writer buffering the response, so that ETag can be set
+type cacheWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	atmiCode int
+}
+
+func (c *cacheWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	if 0 == c.status {
+		c.status = code
+	}
+}
+
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if 0 == c.status {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(b)
+}
+
+//Record ATMI error code of the response
+func (c *cacheWriter) setATMICode(code int) {
+	c.atmiCode = code
+}
+
+//Get the wrapped writer
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.w
+}
+
+//Validate cache settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initCache(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if svc.Cache_ttl < 0 {
+		ac.TpLogError("Route [%s]: invalid cache_ttl %d", svc.Url, svc.Cache_ttl)
+		return fmt.Errorf("Route [%s]: invalid cache_ttl %d", svc.Url,
+			svc.Cache_ttl)
+	}
+
+	if 0 == svc.Cache_ttl {
+		return nil
+	}
+
+	if !isCallConv(svc.Conv_int) ||
+		svc.Asynccall || svc.Echo || svc.Fileupload || svc.Download_conv {
+		ac.TpLogError("Route [%s]: cache_ttl not supported for conv [%s], "+
+			"async, echo, fileupload or download_conv", svc.Url, svc.Conv)
+		return fmt.Errorf("Route [%s]: cache_ttl not supported for conv [%s], "+
+			"async, echo, fileupload or download_conv", svc.Url, svc.Conv)
+	}
+
+	if M_cache_max <= 0 {
+		ac.TpLogError("Invalid cache_max %d", M_cache_max)
+		return fmt.Errorf("Invalid cache_max %d", M_cache_max)
+	}
+
+	//Empty array given explicitly, means no headers in the key
+	if nil == svc.Cache_headers {
+		svc.Cache_headers = M_cacheHeadersDefault
+	}
+
+	ac.TpLogInfo("Route [%s]: GET responses cached for %d sec, query %v "+
+		"headers %v", svc.Url, svc.Cache_ttl, svc.Cache_query, svc.Cache_headers)
+
+	return nil
+}
+
+//Is the request cacheable
+//@param svc service map
+//@param req HTTP request
+func cacheable(svc *ServiceMap, req *http.Request) bool {
+	return svc.Cache_ttl > 0 &&
+		(http.MethodGet == req.Method || http.MethodHead == req.Method)
+}
+
+//Converted request in canonical form (JSON with sorted keys), without
+//request headers, cookies and query
+//@param ac ATMI Context
+//@param svc service map
+//@param buf request buffer
+//@return request data or error
+func cacheBufKey(ac *atmi.ATMICtx, svc *ServiceMap,
+	buf atmi.TypedBuffer) ([]byte, error) {
+
+	var itype, subtype string
+	var data string
+	var skip []string
+
+	if _, errA := ac.TpTypes(buf.GetBuf(), &itype, &subtype); nil != errA {
+		return nil, errA
+	}
+
+	switch itype {
+	case "UBF":
+		bufu, errA := ac.CastToUBF(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		if data, errA = bufu.TpUBFToJSON(); nil != errA {
+			return nil, errA
+		}
+
+		skip = M_cacheSkipFields
+	case "JSON":
+		bufj, errA := ac.CastToJSON(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		data = bufj.GetJSONText()
+		skip = []string{svc.JsonHeaderField, svc.JsonCookieField}
+	case "VIEW":
+		bufv, errA := ac.CastToVIEW(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		if data, errA = bufv.TpVIEWToJSON(svc.View_flags); nil != errA {
+			return nil, errA
+		}
+	case "STRING":
+		bufs, errA := ac.CastToString(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return []byte(bufs.GetString()), nil
+	case "CARRAY":
+		bufc, errA := ac.CastToCarray(buf.GetBuf())
+
+		if nil != errA {
+			return nil, errA
+		}
+
+		return bufc.GetBytes(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported buffer type [%s]", itype)
+	}
+
+	var obj map[string]interface{}
+
+	if err := json.Unmarshal([]byte(data), &obj); nil != err {
+		//Not an object, use as is
+		return []byte(data), nil
+	}
+
+	for _, k := range skip {
+		delete(obj, k)
+	}
+
+	return json.Marshal(obj)
+}
+
+//Build the cache key from method, path, selected query parameters and
+//headers and the converted request
+//@param ac ATMI Context
+//@param svc service map
+//@param req HTTP request
+//@param buf request buffer
+//@return key or error
+func cacheKey(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	buf atmi.TypedBuffer) (string, error) {
+
+	data, err := cacheBufKey(ac, svc, buf)
+
+	if nil != err {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	//HEAD shares the GET response
+	fmt.Fprintf(h, "GET %s\n", req.URL.Path)
+
+	//Responses are not shared between authenticated principals
+	if auth := requestAuth(req); nil != auth {
+		fmt.Fprintf(h, "auth %s\n", auth.User)
+	}
+
+	query := req.URL.Query()
+
+	if len(svc.Cache_query) == 0 {
+		fmt.Fprintf(h, "%s\n", query.Encode())
+	} else {
+		sel := url.Values{}
+
+		for _, q := range svc.Cache_query {
+			if v, ok := query[q]; ok {
+				sel[q] = v
+			}
+		}
+
+		fmt.Fprintf(h, "%s\n", sel.Encode())
+	}
+
+	for _, hn := range svc.Cache_headers {
+		fmt.Fprintf(h, "%s: %s\n", http.CanonicalHeaderKey(hn),
+			strings.Join(req.Header.Values(hn), ","))
+	}
+
+	h.Write(data)
+
+	return svc.Url + " " + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//Get time to live of the response, by the Cache-Control set by service.
+//Responses setting cookies are not cached, as they are client specific.
+//@param svc service map
+//@param hdr response headers
+//@return seconds, 0 - not cacheable
+func cacheTTL(svc *ServiceMap, hdr http.Header) int {
+
+	if len(hdr.Values("Set-Cookie")) > 0 {
+		return 0
+	}
+
+	ttl := svc.Cache_ttl
+
+	for _, d := range strings.Split(hdr.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+
+		switch {
+		case "no-store" == d || "no-cache" == d || "private" == d:
+			return 0
+		case strings.HasPrefix(d, "max-age="):
+			if n, err := strconv.Atoi(d[len("max-age="):]); nil == err {
+				ttl = n
+			}
+		}
+	}
+
+	if ttl < 0 {
+		return 0
+	}
+
+	return ttl
+}
+
+//Check is the ETag in If-None-Match
+//@param req HTTP request
+//@param etag entity tag
+func etagMatch(req *http.Request, etag string) bool {
+
+	for _, t := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+
+		if "*" == t || etag == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Send the response, or 304 if client has it already
+//@param w response writer
+//@param req HTTP request
+//@param hdr response headers
+//@param body response body
+//@param etag entity tag
+func cacheSend(w http.ResponseWriter, req *http.Request, hdr http.Header,
+	body []byte, etag string) {
+
+	for k, v := range hdr {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set("ETag", etag)
+
+	if etagMatch(req, etag) {
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+//Serve the request from cache, or call the service and cache the response.
+//Only successful responses (HTTP 200, no ATMI error) are cached.
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param req HTTP request
+//@param buf request buffer
+//@param flags call flags
+//@param reqlogOpen request log file is open
+//@param rctx request context
+func cachedCall(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, buf atmi.TypedBuffer, flags int64, reqlogOpen bool,
+	rctx *RequestContext) {
+
+	key, err := cacheKey(ac, svc, req, buf)
+
+	if nil != err {
+		ac.TpLogWarn("Failed to build cache key, not cached: %s", err.Error())
+		_, errA := ac.TpCall(svc.Svc, buf, flags)
+		genRsp(ac, buf, svc, w, errA, reqlogOpen, true, true, rctx)
+		return
+	}
+
+	now := time.Now()
+
+	M_cache.mu.Lock()
+
+	e, ok := M_cache.entries[key]
+
+	if ok && now.After(e.expires) {
+		M_cache.lru.Remove(e.elem)
+		delete(M_cache.entries, key)
+		ok = false
+	} else if ok {
+		M_cache.lru.MoveToBack(e.elem)
+	}
+
+	M_cache.mu.Unlock()
+
+	if ok {
+		ac.TpLogInfo("Route [%s]: response from cache", svc.Url)
+		setRspATMICode(w, atmi.TPMINVAL)
+		w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+		cacheSend(w, req, e.header, e.body, e.etag)
+		return
+	}
+
+	cw := cacheWriter{w: w, header: make(http.Header)}
+
+	_, errA := ac.TpCall(svc.Svc, buf, flags)
+	genRsp(ac, buf, svc, &cw, errA, reqlogOpen, true, true, rctx)
+
+	if http.StatusOK != cw.status || atmi.TPMINVAL != cw.atmiCode {
+		//Errors are passed as is
+		for k, v := range cw.header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(cw.status)
+		w.Write(cw.body.Bytes())
+		return
+	}
+
+	sum := sha256.Sum256(cw.body.Bytes())
+	etag := "\"" + hex.EncodeToString(sum[:16]) + "\""
+	cw.header.Del("Content-Length")
+
+	if ttl := cacheTTL(svc, cw.header); ttl > 0 {
+		e = &cacheEntry{key: key, header: cw.header, body: cw.body.Bytes(),
+			etag: etag, stored: now,
+			expires: now.Add(time.Duration(ttl) * time.Second)}
+
+		M_cache.mu.Lock()
+
+		if old, ok := M_cache.entries[key]; ok {
+			M_cache.lru.Remove(old.elem)
+		}
+
+		for M_cache.lru.Len() >= M_cache_max {
+			old := M_cache.lru.Remove(M_cache.lru.Front()).(*cacheEntry)
+			delete(M_cache.entries, old.key)
+		}
+
+		e.elem = M_cache.lru.PushBack(e)
+		M_cache.entries[key] = e
+
+		M_cache.mu.Unlock()
+
+		ac.TpLogInfo("Route [%s]: response cached for %d sec", svc.Url, ttl)
+	}
+
+	cacheSend(w, req, cw.header, cw.body.Bytes(), etag)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,361 @@
+/**
+ * @brief HTTP compression of responses and request bodies
+ *
+ * @file compress.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	ENCODING_GZIP     = "gzip"
+	ENCODING_DEFLATE  = "deflate"
+	ENCODING_IDENTITY = "identity"
+
+	COMPRESS_MIN_SIZE_DEFAULT = 1024 //Do not compress smaller responses
+)
+
+//Content types compressed by default, prefix match
+var M_compressTypesDefault = []string{"application/json", "text/"}
+
+//Encodings supported for responses, in order of preference
+var M_encodings = []string{ENCODING_GZIP, ENCODING_DEFLATE}
+
+//Compressor stream
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+//Response writer, compressing the body if response qualifies
+type compressWriter struct {
+	http.ResponseWriter
+	svc      *ServiceMap
+	encoding string     //Negotiated encoding
+	zw       compressor //Compressor, nil - body sent as is
+	decided  bool       //Headers checked
+}
+
+//Validate compression settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initCompress(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if svc.Compress_min_size < 0 || svc.Max_inflate_size < 0 {
+		ac.TpLogError("Route [%s]: compress_min_size and max_inflate_size "+
+			"must not be negative", svc.Url)
+		return fmt.Errorf("Route [%s]: invalid compression settings", svc.Url)
+	}
+
+	if svc.Compress {
+		ac.TpLogInfo("Route [%s]: response compression, min size %d types %v",
+			svc.Url, svc.Compress_min_size, svc.Compress_types)
+	}
+
+	return nil
+}
+
+//Negotiate response encoding from Accept-Encoding header
+//@param accept Accept-Encoding header value
+//@return encoding or empty if none acceptable
+func negotiateEncoding(accept string) string {
+
+	q := make(map[string]float64)
+
+	for _, item := range strings.Split(accept, ",") {
+
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		weight := 1.0
+
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); nil == err {
+					weight = v
+				}
+			}
+		}
+
+		q[name] = weight
+	}
+
+	best := ""
+	bestq := 0.0
+
+	for _, enc := range M_encodings {
+
+		weight, ok := q[enc]
+
+		if !ok {
+			weight, ok = q["*"]
+		}
+
+		if ok && weight > bestq {
+			best = enc
+			bestq = weight
+		}
+	}
+
+	return best
+}
+
+//Start response compression, if client accepts it
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return compressing writer or nil if not compressing
+func compressBegin(w http.ResponseWriter, req *http.Request,
+	svc *ServiceMap) *compressWriter {
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if http.MethodHead == req.Method {
+		return nil
+	}
+
+	enc := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+
+	if "" == enc {
+		return nil
+	}
+
+	return &compressWriter{ResponseWriter: w, svc: svc, encoding: enc}
+}
+
+//Check is the content type in allowlist of the route
+func (c *compressWriter) typeAllowed(ctype string) bool {
+
+	types := c.svc.Compress_types
+
+	if len(types) == 0 {
+		types = M_compressTypesDefault
+	}
+
+	ctype = strings.ToLower(ctype)
+
+	for _, t := range types {
+		if strings.HasPrefix(ctype, strings.ToLower(t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Decide on compression, when headers are about to be sent
+//@param code HTTP status
+func (c *compressWriter) decide(code int) {
+
+	if c.decided {
+		return
+	}
+
+	c.decided = true
+	hdr := c.Header()
+
+	if code < http.StatusOK || http.StatusNoContent == code ||
+		http.StatusNotModified == code || "" != hdr.Get("Content-Encoding") ||
+		!c.typeAllowed(hdr.Get("Content-Type")) {
+		return
+	}
+
+	//Length unknown (streamed) responses are compressed always
+	if cl := hdr.Get("Content-Length"); "" != cl {
+		if n, err := strconv.Atoi(cl); nil == err && n < c.svc.Compress_min_size {
+			return
+		}
+	}
+
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Encoding", c.encoding)
+
+	if ENCODING_GZIP == c.encoding {
+		c.zw = gzip.NewWriter(c.ResponseWriter)
+	} else {
+		c.zw = zlib.NewWriter(c.ResponseWriter)
+	}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	c.decide(code)
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if nil != c.zw {
+		return c.zw.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+//Flush compressed data, if supported by the underlying writer
+func (c *compressWriter) Flush() {
+
+	if nil != c.zw {
+		c.zw.Flush()
+	}
+
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Get the wrapped writer
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+//Complete the compressed stream
+func (c *compressWriter) Close() {
+	if nil != c.zw {
+		c.zw.Close()
+	}
+}
+
+//Decompress request body with Content-Encoding gzip or deflate. Body is
+//inflated in memory, up to route max_inflate_size and max_body_size, so that
+//errors are reported before any XATMI resources are used. Rejected request is
+//answered with 415 (unknown encoding or upload route), 400 (corrupted data)
+//or 413 (size cap exceeded). Uploads are streamed to disk, thus compressed
+//upload bodies are not accepted.
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return true if request may continue
+func inflateFilter(w http.ResponseWriter, req *http.Request, svc *ServiceMap) bool {
+
+	enc := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+
+	if "" == enc || ENCODING_IDENTITY == enc || nil == req.Body {
+		return true
+	}
+
+	if svc.Fileupload {
+		M_ac.TpLogError("URL [%s] Content-Encoding not supported for uploads, "+
+			"caller: %s", req.URL, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusUnsupportedMediaType,
+			atmi.NewCustomATMIError(atmi.TPEINVAL,
+				"Content-Encoding not supported for uploads"))
+		return false
+	}
+
+	var zr io.ReadCloser
+	var err error
+
+	switch enc {
+	case ENCODING_GZIP, "x-gzip":
+		zr, err = gzip.NewReader(req.Body)
+	case ENCODING_DEFLATE:
+		zr, err = zlib.NewReader(req.Body)
+	default:
+		M_ac.TpLogError("URL [%s] unsupported Content-Encoding [%s], caller: %s",
+			req.URL, enc, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusUnsupportedMediaType,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Unsupported Content-Encoding"))
+		return false
+	}
+
+	if nil != err {
+		M_ac.TpLogError("URL [%s] invalid %s body: %s, caller: %s",
+			req.URL, enc, err.Error(), req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusBadRequest,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Invalid compressed body"))
+		return false
+	}
+
+	defer zr.Close()
+
+	max := svc.Max_inflate_size
+
+	if 0 == max {
+		max = atmi.ATMIMsgSizeMax()
+	}
+
+	//Body limit applies to the inflated body too
+	if limit := bodyLimit(svc); limit > 0 && limit < max {
+		max = limit
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(zr, max+1))
+
+	if isBodyTooLarge(err) {
+		M_ac.TpLogError("URL [%s] compressed body exceeds max_body_size, caller: %s",
+			req.URL, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusRequestEntityTooLarge,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Request body too large"))
+		return false
+	} else if nil != err {
+		M_ac.TpLogError("URL [%s] failed to inflate %s body: %s, caller: %s",
+			req.URL, enc, err.Error(), req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusBadRequest,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Invalid compressed body"))
+		return false
+	}
+
+	if int64(len(body)) > max {
+		M_ac.TpLogError("URL [%s] inflated body exceeds %d bytes, caller: %s",
+			req.URL, max, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusRequestEntityTooLarge,
+			atmi.NewCustomATMIError(atmi.TPEINVAL,
+				"Decompressed body too large"))
+		return false
+	}
+
+	M_ac.TpLogDebug("URL [%s] inflated %s body, %d bytes", req.URL, enc, len(body))
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Del("Content-Encoding")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return true
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,500 @@
+/**
+ * @brief Conversational data streaming between HTTP and XATMI services
+ *
+ * @file convstream.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	UPLOAD_CHUNK_DEFAULT = 32768 //File data bytes sent per tpsend
+	UPLOAD_CHUNK_RESERVE = 4096  //Message space reserved for part metadata
+)
+
+//Validate conversational streaming settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initConvStream(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if svc.Upload_conv {
+		if !svc.Fileupload {
+			ac.TpLogError("Route [%s]: upload_conv requires fileupload", svc.Url)
+			return fmt.Errorf("Route [%s]: upload_conv requires fileupload",
+				svc.Url)
+		}
+
+		if svc.Download_conv || svc.Asynccall || svc.Echo {
+			ac.TpLogError("Route [%s]: upload_conv cannot be used with "+
+				"download_conv, async or echo", svc.Url)
+			return fmt.Errorf("Route [%s]: upload_conv cannot be used with "+
+				"download_conv, async or echo", svc.Url)
+		}
+
+		if 0 == svc.Upload_chunk_size {
+			svc.Upload_chunk_size = UPLOAD_CHUNK_DEFAULT
+		}
+
+		if svc.Upload_chunk_size < 0 || svc.Upload_chunk_size >
+			int(atmi.ATMIMsgSizeMax())-UPLOAD_CHUNK_RESERVE {
+			ac.TpLogError("Route [%s]: invalid upload_chunk_size %d, max %d",
+				svc.Url, svc.Upload_chunk_size,
+				int(atmi.ATMIMsgSizeMax())-UPLOAD_CHUNK_RESERVE)
+			return fmt.Errorf("Route [%s]: invalid upload_chunk_size %d",
+				svc.Url, svc.Upload_chunk_size)
+		}
+
+		ac.TpLogInfo("Route [%s]: upload by conversation with [%s], chunk %d",
+			svc.Url, svc.Svc, svc.Upload_chunk_size)
+	}
+
+	if !svc.Download_conv {
+		return nil
+	}
+
+	if !isCallConv(svc.Conv_int) {
+		ac.TpLogError("Route [%s]: download_conv not supported for conv [%s]",
+			svc.Url, svc.Conv)
+		return fmt.Errorf("Route [%s]: download_conv not supported for conv [%s]",
+			svc.Url, svc.Conv)
+	}
+
+	if svc.Asynccall || svc.Echo || svc.Stream {
+		ac.TpLogError("Route [%s]: download_conv cannot be used with "+
+			"async, echo or stream", svc.Url)
+		return fmt.Errorf("Route [%s]: download_conv cannot be used with "+
+			"async, echo or stream", svc.Url)
+	}
+
+	ac.TpLogInfo("Route [%s]: download by conversation with [%s]",
+		svc.Url, svc.Svc)
+
+	return nil
+}
+
+//Get data chunk received from the conversation
+//@param ac ATMI Context
+//@param buf received buffer
+//@return chunk data, UBF buffer (if UBF received) or error
+func convChunk(ac *atmi.ATMICtx, buf atmi.TypedBuffer) ([]byte,
+	*atmi.TypedUBF, atmi.ATMIError) {
+
+	var itype, subtype string
+
+	if _, errA := ac.TpTypes(buf.GetBuf(), &itype, &subtype); nil != errA {
+		return nil, nil, errA
+	}
+
+	switch itype {
+	case "CARRAY":
+		bufc, errA := ac.CastToCarray(buf.GetBuf())
+
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		return bufc.GetBytes(), nil, nil
+	case "STRING":
+		bufs, errA := ac.CastToString(buf.GetBuf())
+
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		return []byte(bufs.GetString()), nil, nil
+	case "UBF":
+		bufu, errA := ac.CastToUBF(buf.GetBuf())
+
+		if nil != errA {
+			return nil, nil, errA
+		}
+
+		if !bufu.BPres(ubftab.EX_IF_RSPDATA, 0) {
+			return nil, bufu, nil
+		}
+
+		data, errU := bufu.BGetByteArr(ubftab.EX_IF_RSPDATA, 0)
+
+		if nil != errU {
+			return nil, nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to get EX_IF_RSPDATA: %s", errU.Message()))
+		}
+
+		return data, bufu, nil
+	}
+
+	return nil, nil, atmi.NewCustomATMIError(atmi.TPEOTYPE,
+		fmt.Sprintf("Unsupported chunk buffer type [%s]", itype))
+}
+
+//Call the service in conversational mode and write the received chunks to
+//the client. Service sends the data with tpsend(3) in CARRAY, STRING or UBF
+//(EX_IF_RSPDATA) buffers, last chunk may be returned by tpreturn(3).
+//Until first chunk is written, errors are answered by genRsp(). Later the
+//status is already sent, thus failure aborts the response, so that client
+//sees incomplete transfer.
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param buf request buffer
+//@param flags call flags
+//@param reqlogOpen request log file is open
+//@param rctx request context
+//@return true if response must be aborted
+func convDownload(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	buf atmi.TypedBuffer, flags int64, reqlogOpen bool,
+	rctx *RequestContext) bool {
+
+	cd, errA := ac.TpConnect(svc.Svc, buf, flags|atmi.TPRECVONLY)
+
+	if nil != errA {
+		ac.TpLogError("Failed to connect to [%s]: %s", svc.Svc, errA.Message())
+		genRsp(ac, buf, svc, w, errA, reqlogOpen, true, false, rctx)
+		return false
+	}
+
+	rbuf, errA := ac.NewCarray(nil)
+
+	if nil != errA {
+		ac.TpLogError("Failed to alloc receive buffer: %s", errA.Message())
+		ac.TpDiscon(cd)
+		genRsp(ac, nil, svc, w, errA, reqlogOpen, false, false, rctx)
+		return false
+	}
+
+	rc := http.NewResponseController(w)
+	started := false
+	var total int64
+	var chunks int
+
+	for {
+		revent, errR := ac.TpRecv(cd, rbuf, flags&atmi.TPNOTIME)
+		done := false
+
+		if nil != errR {
+			if atmi.TPEEVENT == errR.Code() && atmi.TPEV_SVCSUCC == revent {
+				done = true
+			} else {
+				ac.TpLogError("Download from [%s] failed after %d bytes: %d:%s "+
+					"(event %d)", svc.Svc, total, errR.Code(), errR.Message(),
+					revent)
+
+				//Conversation is over by the service events, except send-only
+				if atmi.TPEEVENT == errR.Code() && atmi.TPEV_SVCFAIL == revent {
+					errR = atmi.NewCustomATMIError(atmi.TPESVCFAIL,
+						"Service failed")
+				} else if atmi.TPEEVENT == errR.Code() {
+					if atmi.TPEV_SENDONLY == revent {
+						ac.TpDiscon(cd)
+					}
+					errR = atmi.NewCustomATMIError(atmi.TPESVCERR,
+						"Conversation aborted")
+				} else {
+					ac.TpDiscon(cd)
+				}
+
+				if started {
+					return true
+				}
+
+				genRsp(ac, nil, svc, w, errR, reqlogOpen, false, false, rctx)
+				return false
+			}
+		}
+
+		data, bufu, errC := convChunk(ac, rbuf)
+
+		if nil != errC {
+			ac.TpLogError("Invalid chunk from [%s]: %s", svc.Svc, errC.Message())
+
+			if !done {
+				ac.TpDiscon(cd)
+			}
+
+			if started {
+				return true
+			}
+
+			genRsp(ac, nil, svc, w, errC, reqlogOpen, false, false, rctx)
+			return false
+		}
+
+		if !started {
+			rspType := "application/octet-stream"
+
+			//Headers are taken from first chunk
+			if nil != bufu {
+				if t := genRspHeaders(ac, bufu, w, svc); "" != t {
+					rspType = t
+				}
+			}
+
+			//Transfer may take longer than write_timeout
+			if err := rc.SetWriteDeadline(time.Time{}); nil != err {
+				ac.TpLogDebug("Write deadline not reset: %s", err)
+			}
+
+			w.Header().Set("Content-Type", rspType)
+			setRspATMICode(w, atmi.TPMINVAL)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		if len(data) > 0 {
+			if _, err := w.Write(data); nil != err {
+				ac.TpLogError("Client gone after %d bytes: %s", total, err)
+
+				if !done {
+					ac.TpDiscon(cd)
+				}
+
+				return false
+			}
+
+			rc.Flush()
+			total += int64(len(data))
+			chunks++
+		}
+
+		if done {
+			break
+		}
+	}
+
+	ac.TpLogInfo("Download from [%s] completed: %d bytes in %d chunks",
+		svc.Svc, total, chunks)
+
+	return false
+}
+
+//Call the service in conversational mode and stream the uploaded files to
+//it, instead of temporary files. Request buffer is sent by tpconnect(3),
+//then each multipart part is sent by tpsend(3) in chunks of
+//upload_chunk_size bytes (EX_IF_REQDATA) with the part metadata. Last
+//message (no data) passes control to service, which answers by tpreturn(3).
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param req HTTP request
+//@param bufu request buffer
+//@param flags call flags
+//@param reqlogOpen request log file is open
+//@param rctx request context
+func convUpload(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, bufu *atmi.TypedUBF, flags int64, reqlogOpen bool,
+	rctx *RequestContext) {
+
+	var total int64
+	var part int
+
+	mr, err := req.MultipartReader()
+
+	if nil != err {
+		ac.TpLogError("Failed to open multi-part reader: %s", err.Error())
+		rctx.errSrc = ERRSRC_RESTIN
+		genRsp(ac, bufu, svc, w, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to open multi-part reader: %s", err.Error())),
+			reqlogOpen, false, false, rctx)
+		return
+	}
+
+	cd, errA := ac.TpConnect(svc.Svc, bufu, flags|atmi.TPSENDONLY)
+
+	if nil != errA {
+		ac.TpLogError("Failed to connect to [%s]: %s", svc.Svc, errA.Message())
+		genRsp(ac, bufu, svc, w, errA, reqlogOpen, true, false, rctx)
+		return
+	}
+
+	//Reject the upload, by the rest-in
+	fail := func(errA atmi.ATMIError) {
+		ac.TpDiscon(cd)
+		rctx.errSrc = ERRSRC_RESTIN
+		genRsp(ac, bufu, svc, w, errA, reqlogOpen, false, false, rctx)
+	}
+
+	//Service failed while receiving the data
+	svcfail := func(errS atmi.ATMIError, revent int) {
+		ac.TpLogError("Upload to [%s] failed after %d bytes: %d:%s (event %d)",
+			svc.Svc, total, errS.Code(), errS.Message(), revent)
+
+		if atmi.TPEEVENT != errS.Code() {
+			ac.TpDiscon(cd)
+		} else if atmi.TPEV_SVCFAIL == revent {
+			errS = atmi.NewCustomATMIError(atmi.TPESVCFAIL, "Service failed")
+		} else {
+			errS = atmi.NewCustomATMIError(atmi.TPESVCERR, "Conversation aborted")
+		}
+
+		genRsp(ac, bufu, svc, w, errS, reqlogOpen, true, false, rctx)
+	}
+
+	chunk, errA := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+	if nil != errA {
+		fail(errA)
+		return
+	}
+
+	data := make([]byte, svc.Upload_chunk_size)
+
+	for ; ; part++ {
+		p, err := mr.NextPart()
+
+		if io.EOF == err {
+			break
+		} else if isBodyTooLarge(err) {
+			fail(uploadTooLarge(ac, req, rctx, "Request body too large"))
+			return
+		} else if nil != err {
+			ac.TpLogError("Error while fetching next part: %s", err.Error())
+			fail(atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Error while fetching next part: %s", err.Error())))
+			return
+		}
+
+		ac.TpLogInfo("Streaming part %d form [%s] file [%s]", part,
+			p.FormName(), p.FileName())
+
+		var filesize int64
+
+		//Each part is sent at least once, even if empty
+		for first := true; ; first = false {
+			n, err := io.ReadFull(p, data)
+			last := io.EOF == err || io.ErrUnexpectedEOF == err
+
+			if isBodyTooLarge(err) {
+				fail(uploadTooLarge(ac, req, rctx, "Request body too large"))
+				return
+			} else if nil != err && !last {
+				ac.TpLogError("Error reading part %d: %s", part, err.Error())
+				fail(atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Error reading part %d: %s", part, err.Error())))
+				return
+			}
+
+			filesize += int64(n)
+			total += int64(n)
+
+			if svc.Max_file_size > 0 && filesize > svc.Max_file_size {
+				fail(uploadTooLarge(ac, req, rctx, fmt.Sprintf(
+					"File [%s] exceeds %d bytes", p.FileName(), svc.Max_file_size)))
+				return
+			}
+
+			if svc.Max_upload_size > 0 && total > svc.Max_upload_size {
+				fail(uploadTooLarge(ac, req, rctx, fmt.Sprintf(
+					"Upload exceeds %d bytes", svc.Max_upload_size)))
+				return
+			}
+
+			if n > 0 || first {
+				chunk.BChg(ubftab.EX_IF_REQFILEPART, 0, part)
+				chunk.BChg(ubftab.EX_IF_REQFILENAME, 0, p.FileName())
+				chunk.BChg(ubftab.EX_IF_REQFILEFORM, 0, p.FormName())
+				chunk.BChg(ubftab.EX_IF_REQFILEMIME, 0, p.Header.Get("Content-Type"))
+
+				if errU := chunk.BChg(ubftab.EX_IF_REQDATA, 0,
+					data[:n]); nil != errU {
+					fail(atmi.NewCustomATMIError(atmi.TPESYSTEM,
+						fmt.Sprintf("Failed to set EX_IF_REQDATA: %s",
+							errU.Message())))
+					return
+				}
+
+				if revent, errS := ac.TpSend(cd, chunk, 0); nil != errS {
+					svcfail(errS, revent)
+					return
+				}
+			}
+
+			if last {
+				break
+			}
+		}
+
+		ac.TpLogInfo("Streamed part %d: %d bytes", part, filesize)
+	}
+
+	metricsUploads(svc, req, part)
+
+	//End of data, pass the control to service
+	end, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		fail(errA)
+		return
+	}
+
+	if revent, errS := ac.TpSend(cd, end, atmi.TPRECVONLY); nil != errS {
+		svcfail(errS, revent)
+		return
+	}
+
+	ac.TpLogInfo("Upload of %d parts, %d bytes streamed to [%s]", part, total,
+		svc.Svc)
+
+	rsp, errA := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+	if nil != errA {
+		fail(errA)
+		return
+	}
+
+	revent, errR := ac.TpRecv(cd, rsp, flags&atmi.TPNOTIME)
+
+	switch {
+	case nil != errR && atmi.TPEEVENT == errR.Code() &&
+		atmi.TPEV_SVCSUCC == revent:
+		genRsp(ac, rsp, svc, w, nil, reqlogOpen, true, true, rctx)
+	case nil != errR && atmi.TPEEVENT == errR.Code() &&
+		atmi.TPEV_SVCFAIL == revent:
+		genRsp(ac, rsp, svc, w, atmi.NewCustomATMIError(atmi.TPESVCFAIL,
+			"Service failed"), reqlogOpen, true, true, rctx)
+	case nil != errR:
+		svcfail(errR, revent)
+	default:
+		ac.TpLogError("Service [%s] sent data instead of return", svc.Svc)
+		ac.TpDiscon(cd)
+		genRsp(ac, bufu, svc, w, atmi.NewCustomATMIError(atmi.TPESVCERR,
+			"Unexpected message from service"), reqlogOpen, true, false, rctx)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
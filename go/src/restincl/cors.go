@@ -0,0 +1,252 @@
+/**
+ * @brief Cross-Origin Resource Sharing (CORS) support
+ *
+ * @file cors.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	CORS_ANY_ORIGIN = "*" //Any origin allowed
+)
+
+//Default methods announced in preflight, if route accepts any method
+var M_corsMethodsDefault = []string{http.MethodGet, http.MethodPost,
+	http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+//Convert origin with wildcards to anchored regexp
+//@param origin origin, e.g. https://*.example.com
+//@return regexp string
+func corsOriginToRegexp(origin string) string {
+	return "^" + strings.Replace(regexp.QuoteMeta(origin), "\\*", ".*", -1) + "$"
+}
+
+//Validate CORS settings of the route and compile the origins
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initCors(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Cors_rex = nil
+	svc.Cors_any = false
+
+	if svc.Cors_max_age < 0 {
+		ac.TpLogError("Route [%s]: cors_max_age must not be negative", svc.Url)
+		return fmt.Errorf("Route [%s]: invalid cors_max_age %d",
+			svc.Url, svc.Cors_max_age)
+	}
+
+	for _, origin := range svc.Cors_origins {
+
+		if CORS_ANY_ORIGIN == origin {
+			svc.Cors_any = true
+			continue
+		}
+
+		r, err := regexp.Compile(corsOriginToRegexp(origin))
+
+		if nil != err {
+			ac.TpLogError("Route [%s]: invalid CORS origin [%s]: %s",
+				svc.Url, origin, err.Error())
+			return fmt.Errorf("Route [%s]: invalid CORS origin [%s]: %s",
+				svc.Url, origin, err.Error())
+		}
+
+		svc.Cors_rex = append(svc.Cors_rex, r)
+	}
+
+	for i, m := range svc.Cors_methods {
+		svc.Cors_methods[i] = strings.ToUpper(m)
+	}
+
+	if len(svc.Cors_origins) > 0 {
+		ac.TpLogInfo("Route [%s]: CORS origins %v methods %v headers %v "+
+			"credentials %t max age %d", svc.Url, svc.Cors_origins,
+			svc.Cors_methods, svc.Cors_headers, svc.Cors_credentials,
+			svc.Cors_max_age)
+	}
+
+	return nil
+}
+
+//Check is the origin allowed by the route
+//@param svc service map
+//@param origin Origin header value
+//@return true if allowed
+func corsAllowed(svc *ServiceMap, origin string) bool {
+
+	if svc.Cors_any {
+		return true
+	}
+
+	for _, r := range svc.Cors_rex {
+		if r.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Set the CORS response headers for the request
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return true if request is cross-origin and origin is allowed
+func corsHeaders(w http.ResponseWriter, req *http.Request, svc *ServiceMap) bool {
+
+	origin := req.Header.Get("Origin")
+
+	if "" == origin || len(svc.Cors_origins) == 0 {
+		return false
+	}
+
+	hdr := w.Header()
+	hdr.Add("Vary", "Origin")
+
+	if !corsAllowed(svc, origin) {
+		M_ac.TpLogWarn("Route [%s]: CORS origin [%s] not allowed",
+			svc.Url, origin)
+		return false
+	}
+
+	//With credentials, the wildcard is not accepted by browsers
+	if svc.Cors_any && !svc.Cors_credentials {
+		hdr.Set("Access-Control-Allow-Origin", CORS_ANY_ORIGIN)
+	} else {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if svc.Cors_credentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if len(svc.Cors_expose) > 0 {
+		hdr.Set("Access-Control-Expose-Headers", strings.Join(svc.Cors_expose, ", "))
+	}
+
+	return true
+}
+
+//Check is the request CORS preflight
+//@param req HTTP request
+//@return true if preflight
+func isPreflight(req *http.Request) bool {
+	return http.MethodOptions == req.Method && "" != req.Header.Get("Origin") &&
+		"" != req.Header.Get("Access-Control-Request-Method")
+}
+
+//Answer the CORS preflight request, without calling XATMI
+//@param w response writer
+//@param req HTTP request
+//@param svc route of the requested method
+func corsPreflight(w http.ResponseWriter, req *http.Request, svc *ServiceMap) {
+
+	if !corsHeaders(w, req, svc) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Add("Vary", "Access-Control-Request-Method")
+	hdr.Add("Vary", "Access-Control-Request-Headers")
+
+	methods := svc.Cors_methods
+
+	if len(methods) == 0 {
+		methods = svc.Methods
+	}
+
+	if len(methods) == 0 {
+		methods = M_corsMethodsDefault
+	}
+
+	hdr.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	if len(svc.Cors_headers) > 0 {
+		hdr.Set("Access-Control-Allow-Headers", strings.Join(svc.Cors_headers, ", "))
+	} else if reqHdrs := req.Header.Get("Access-Control-Request-Headers"); "" != reqHdrs {
+		//No list configured, allow the headers requested
+		hdr.Set("Access-Control-Allow-Headers", reqHdrs)
+	}
+
+	if svc.Cors_max_age > 0 {
+		hdr.Set("Access-Control-Max-Age", strconv.Itoa(svc.Cors_max_age))
+	}
+
+	M_ac.TpLogDebug("Route [%s]: CORS preflight answered for [%s]",
+		svc.Url, req.Header.Get("Origin"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Find the CORS enabled route of the preflight request, i.e. route serving
+//the requested method
+//@param req HTTP request (preflight)
+//@param listener listener name of the request
+//@return route settings or nil if not found or CORS not configured
+func (h *RegexpHandler) preflightRoute(req *http.Request, listener string) *ServiceMap {
+
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+
+	for _, key := range []string{routeMethodKey(method, req.URL.Path), req.URL.Path} {
+		svc, ok := h.urlMap[key]
+		if ok && boundToListener(svc.Listeners, listener) {
+			if len(svc.Cors_origins) > 0 {
+				return &svc
+			}
+			return nil
+		}
+	}
+
+	for _, route := range h.regexpRoutes {
+		if boundToListener(route.listeners, listener) &&
+			route.pattern.MatchString(req.URL.Path) &&
+			acceptsMethod(route.methods, method) {
+			if len(route.svc.Cors_origins) > 0 {
+				return &route.svc
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -56,6 +56,7 @@ const (
 type RequestContext struct {
 	errSrc   string
 	fileList []string
+	httpCode int //Forced HTTP status of error response, 0 - by error mapping
 }
 
 //Prepare file upload (request part, download & prepare the UBF buffer)
@@ -71,6 +72,7 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 	var n int
 	var err error
 	var occ = 0
+	var total int64 //Total bytes of files uploaded
 	// define pointers for the multipart reader and its parts
 	var mr *multipart.Reader
 	var part *multipart.Part
@@ -93,13 +95,16 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 		var uploaded bool
 
 		if part, err = mr.NextPart(); err != nil {
-			if err != io.EOF {
+			if isBodyTooLarge(err) {
+				return uploadTooLarge(ac, r, rctx, "Request body too large")
+			} else if err != io.EOF {
 				ac.TpLogError("Error while fetching next part: %s", err.Error())
 				return atmi.NewCustomATMIError(atmi.TPESYSTEM,
 					fmt.Sprintf("Error while fetching next part: %s", err.Error()))
 
 			} else {
 				ac.TpLogInfo("Multipart upload OK")
+				metricsUploads(svc, r, len(rctx.fileList))
 				return nil
 			}
 		}
@@ -148,7 +153,9 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 		// Read all parts of the file & write off to disk...
 		for !uploaded {
 			if n, err = part.Read(chunk); err != nil {
-				if err != io.EOF {
+				if isBodyTooLarge(err) {
+					return uploadTooLarge(ac, r, rctx, "Request body too large")
+				} else if err != io.EOF {
 					ac.TpLogError("Error reading chunk: %s", err.Error())
 					return atmi.NewCustomATMIError(atmi.TPESYSTEM,
 						fmt.Sprintf("Error reading chunk: %s", err.Error()))
@@ -162,6 +169,17 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 					fmt.Sprintf("Error writing chunk [%s] to: %s", tempfile.Name(), err.Error()))
 			}
 			filesize += n
+			total += int64(n)
+
+			if svc.Max_file_size > 0 && int64(filesize) > svc.Max_file_size {
+				return uploadTooLarge(ac, r, rctx, fmt.Sprintf(
+					"File [%s] exceeds %d bytes", part.FileName(), svc.Max_file_size))
+			}
+
+			if svc.Max_upload_size > 0 && total > svc.Max_upload_size {
+				return uploadTooLarge(ac, r, rctx, fmt.Sprintf(
+					"Upload exceeds %d bytes", svc.Max_upload_size))
+			}
 		}
 
 		ac.TpLogInfo("Uploaded file [%s] size: %d bytes", tempfile.Name(), filesize)
@@ -171,6 +189,39 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 }
 
+//Reject upload over the size limits with 413
+//@param ac ATMI Context
+//@param r HTTP request
+//@param rctx request context attributes
+//@param msg reason
+//@return ATMI error
+func uploadTooLarge(ac *atmi.ATMICtx, r *http.Request, rctx *RequestContext,
+	msg string) atmi.ATMIError {
+
+	ac.TpLogError("URL [%s] upload rejected: %s, caller: %s",
+		r.URL, msg, r.RemoteAddr)
+	rctx.httpCode = http.StatusRequestEntityTooLarge
+
+	return atmi.NewCustomATMIError(atmi.TPEINVAL, msg)
+}
+
+//Remove the temporary files not processed by handleFileUploadRsp(), i.e.
+//upload failed or response was not received (service crash, timeout)
+//@param ac ATMI Context
+//@param rctx request context attributes
+func removeUploads(ac *atmi.ATMICtx, rctx *RequestContext) {
+
+	for _, s := range rctx.fileList {
+		ac.TpLogInfo("Removing file [%s] of unfinished upload", s)
+
+		if err := os.Remove(s); nil != err && !os.IsNotExist(err) {
+			ac.TpLogError("Failed to remove [%s]: %s", s, err.Error())
+		}
+	}
+
+	rctx.fileList = nil
+}
+
 //Handle response after the file processed
 //@param ac ATMI Context
 //@param ubfu UBF buffer used for request handling
@@ -194,6 +245,9 @@ func handleFileUploadRsp(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 		}
 	}
 
+	//All files are handled, kept ones belong to the service
+	rctx.fileList = nil
+
 	return nil
 }
 
@@ -0,0 +1,466 @@
+/**
+ * @brief Idempotency-Key handling, cached responses of repeated requests
+ *
+ * @file idempotency.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	IDEM_HEADER          = "Idempotency-Key"
+	IDEM_REPLAYED_HEADER = "Idempotent-Replayed"
+	IDEM_KEY_MAX         = 255   //Max key length
+	IDEM_TTL_DEFAULT     = 86400 //Entry time to live, seconds
+	IDEM_MAX_DEFAULT     = 10000 //Max entries in the store
+)
+
+//Response stored for the key
+type idemEntry struct {
+	Key         string      `json:"key"`
+	Fingerprint string      `json:"fp"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	Expires     int64       `json:"expires"` //Unix time
+	done        bool        //Response is stored, false - request in progress
+	elem        *list.Element
+}
+
+//Bounded store of the responses, in order of insertion
+type idemStore struct {
+	mu      sync.Mutex
+	entries map[string]*idemEntry
+	order   *list.List
+	file    *os.File //Persistence journal, nil - in-memory only
+	lines   int      //Entries written to the journal
+}
+
+var M_idem_max int = IDEM_MAX_DEFAULT //Max entries in the store
+var M_idem_file string                //Persistence file, empty - none
+
+var M_idem = idemStore{entries: make(map[string]*idemEntry), order: list.New()}
+
+//Response writer recording the response for the store
+type idemWriter struct {
+	http.ResponseWriter
+	entry     *idemEntry  //Reserved entry
+	status    int         //HTTP status sent
+	header    http.Header //Headers sent
+	body      bytes.Buffer
+	processed bool //Request processed by handleMessage
+}
+
+func (iw *idemWriter) WriteHeader(code int) {
+	if 0 == iw.status {
+		iw.status = code
+		iw.header = iw.Header().Clone()
+	}
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *idemWriter) Write(b []byte) (int, error) {
+	if 0 == iw.status {
+		iw.WriteHeader(http.StatusOK)
+	}
+	iw.body.Write(b)
+	return iw.ResponseWriter.Write(b)
+}
+
+//Get the wrapped writer
+func (iw *idemWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+//Validate idempotency settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initIdempotency(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Idempotency {
+		return nil
+	}
+
+	if !isCallConv(svc.Conv_int) ||
+		svc.Download_conv {
+		ac.TpLogError("Route [%s]: idempotency not supported for conv [%s] "+
+			"or download_conv", svc.Url, svc.Conv)
+		return fmt.Errorf("Route [%s]: idempotency not supported for conv [%s] "+
+			"or download_conv", svc.Url, svc.Conv)
+	}
+
+	if UNSET == svc.Idempotency_ttl {
+		svc.Idempotency_ttl = IDEM_TTL_DEFAULT
+	} else if svc.Idempotency_ttl <= 0 {
+		ac.TpLogError("Route [%s]: invalid idempotency_ttl %d", svc.Url,
+			svc.Idempotency_ttl)
+		return fmt.Errorf("Route [%s]: invalid idempotency_ttl %d", svc.Url,
+			svc.Idempotency_ttl)
+	}
+
+	ac.TpLogInfo("Route [%s]: %s honoured, ttl %d sec", svc.Url, IDEM_HEADER,
+		svc.Idempotency_ttl)
+
+	return nil
+}
+
+//Open the store, load persisted entries (not expired) and compact the file
+//@param ac ATMI Context
+//@return error
+func initIdemStore(ac *atmi.ATMICtx) error {
+
+	if M_idem_max <= 0 {
+		ac.TpLogError("Invalid idempotency_max %d", M_idem_max)
+		return fmt.Errorf("Invalid idempotency_max %d", M_idem_max)
+	}
+
+	if "" == M_idem_file {
+		ac.TpLogInfo("Idempotency store in memory, max %d entries", M_idem_max)
+		return nil
+	}
+
+	now := time.Now().Unix()
+
+	if f, err := os.Open(M_idem_file); nil == err {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), int(atmi.ATMIMsgSizeMax())*4+64*1024)
+
+		for sc.Scan() {
+			var e idemEntry
+
+			if err := json.Unmarshal(sc.Bytes(), &e); nil != err {
+				ac.TpLogWarn("Skipping invalid entry in [%s]: %s",
+					M_idem_file, err.Error())
+				continue
+			}
+
+			if e.Expires > now {
+				e.done = true
+				M_idem.add(&e)
+			}
+		}
+
+		if err := sc.Err(); nil != err {
+			ac.TpLogWarn("Failed to read [%s]: %s", M_idem_file, err.Error())
+		}
+
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		ac.TpLogError("Failed to open [%s]: %s", M_idem_file, err.Error())
+		return err
+	}
+
+	if err := M_idem.compact(); nil != err {
+		ac.TpLogError("Failed to write [%s]: %s", M_idem_file, err.Error())
+		return err
+	}
+
+	ac.TpLogInfo("Idempotency store [%s] loaded: %d entries, max %d",
+		M_idem_file, len(M_idem.entries), M_idem_max)
+
+	return nil
+}
+
+//Add entry, evict oldest completed or expired entries over the max
+//Store must be locked
+//@param e entry
+func (s *idemStore) add(e *idemEntry) {
+
+	if old, ok := s.entries[e.Key]; ok {
+		s.order.Remove(old.elem)
+	}
+
+	now := time.Now().Unix()
+
+	for el := s.order.Front(); nil != el && len(s.entries) >= M_idem_max; {
+		next := el.Next()
+		old := el.Value.(*idemEntry)
+
+		if old.done || old.Expires <= now {
+			s.order.Remove(el)
+			delete(s.entries, old.Key)
+		}
+
+		el = next
+	}
+
+	e.elem = s.order.PushBack(e)
+	s.entries[e.Key] = e
+}
+
+//Remove the entry. Store must be locked
+//@param e entry
+func (s *idemStore) remove(e *idemEntry) {
+
+	if cur, ok := s.entries[e.Key]; ok && cur == e {
+		s.order.Remove(e.elem)
+		delete(s.entries, e.Key)
+	}
+}
+
+//Rewrite the journal with current entries. Store must be locked
+//(or not shared yet)
+//@return error
+func (s *idemStore) compact() error {
+
+	tmp := M_idem_file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if nil != err {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	lines := 0
+
+	for el := s.order.Front(); nil != el; el = el.Next() {
+		if e := el.Value.(*idemEntry); e.done {
+			line, _ := json.Marshal(e)
+			bw.Write(append(line, '\n'))
+			lines++
+		}
+	}
+
+	if err = bw.Flush(); nil != err {
+		f.Close()
+		return err
+	}
+
+	f.Close()
+
+	if err = os.Rename(tmp, M_idem_file); nil != err {
+		return err
+	}
+
+	if nil != s.file {
+		s.file.Close()
+	}
+
+	s.file, err = os.OpenFile(M_idem_file, os.O_APPEND|os.O_WRONLY, 0600)
+	s.lines = lines
+
+	return err
+}
+
+//Write completed entry to the journal, compact when journal has twice
+//the max entries. Store must be locked
+//@param ac ATMI Context
+//@param e entry
+func (s *idemStore) persist(ac *atmi.ATMICtx, e *idemEntry) {
+
+	if nil == s.file {
+		return
+	}
+
+	if s.lines >= 2*M_idem_max {
+		if err := s.compact(); nil != err {
+			ac.TpLogError("Failed to compact [%s]: %s", M_idem_file, err.Error())
+		}
+		return
+	}
+
+	line, _ := json.Marshal(e)
+
+	if _, err := s.file.Write(append(line, '\n')); nil != err {
+		ac.TpLogError("Failed to write [%s]: %s", M_idem_file, err.Error())
+		return
+	}
+
+	s.lines++
+}
+
+//Fingerprint of the request, to detect key reused for other request.
+//Upload bodies are not hashed
+//@param req HTTP request
+//@param body request body
+//@return fingerprint
+func idemFingerprint(req *http.Request, body []byte) string {
+
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//Send the stored response
+//@param w response writer
+//@param e entry
+func idemReplay(w http.ResponseWriter, e *idemEntry) {
+
+	for k, v := range e.Header {
+		w.Header()[k] = v
+	}
+
+	w.Header().Set(IDEM_REPLAYED_HEADER, "true")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(e.Body)))
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
+
+//Check the Idempotency-Key of the request. Stored response is replayed,
+//request with the key in progress is rejected with 409, key reused for other
+//request with 422. Otherwise the key is reserved and response is recorded.
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return writer recording the response (nil if key not given) and
+//	true if request shall be processed
+func idemBegin(w http.ResponseWriter, req *http.Request,
+	svc *ServiceMap) (*idemWriter, bool) {
+
+	key := req.Header.Get(IDEM_HEADER)
+
+	if "" == key {
+		return nil, true
+	}
+
+	if len(key) > IDEM_KEY_MAX {
+		genHTTPErrRsp(M_ac, svc, w, http.StatusBadRequest,
+			atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("%s too long", IDEM_HEADER)))
+		return nil, false
+	}
+
+	var body []byte
+
+	if !svc.Fileupload {
+		var err error
+
+		if body, err = ioutil.ReadAll(req.Body); isBodyTooLarge(err) {
+			genHTTPErrRsp(M_ac, svc, w, http.StatusRequestEntityTooLarge,
+				atmi.NewCustomATMIError(atmi.TPEINVAL, "Request body too large"))
+			return nil, false
+		} else if nil != err {
+			M_ac.TpLogError("Failed to read body of %s: %s", req.RemoteAddr,
+				err.Error())
+			genHTTPErrRsp(M_ac, svc, w, http.StatusBadRequest,
+				atmi.NewCustomATMIError(atmi.TPEINVAL, "Failed to read body"))
+			return nil, false
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	//Key is scoped by route and authenticated principal
+	skey := svc.Url + "\n" + key
+
+	if auth := requestAuth(req); nil != auth {
+		skey = auth.User + "\n" + skey
+	}
+
+	fp := idemFingerprint(req, body)
+	now := time.Now().Unix()
+
+	M_idem.mu.Lock()
+	defer M_idem.mu.Unlock()
+
+	e, ok := M_idem.entries[skey]
+
+	if ok && e.Expires <= now {
+		M_idem.remove(e)
+		ok = false
+	}
+
+	switch {
+	case ok && e.Fingerprint != fp:
+		M_ac.TpLogWarn("%s [%s] reused for other request, caller: %s",
+			IDEM_HEADER, key, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusUnprocessableEntity,
+			atmi.NewCustomATMIError(atmi.TPEMATCH,
+				fmt.Sprintf("%s reused for other request", IDEM_HEADER)))
+		return nil, false
+	case ok && !e.done:
+		M_ac.TpLogWarn("%s [%s] request in progress, caller: %s",
+			IDEM_HEADER, key, req.RemoteAddr)
+		genHTTPErrRsp(M_ac, svc, w, http.StatusConflict,
+			atmi.NewCustomATMIError(atmi.TPEMATCH,
+				fmt.Sprintf("Request with %s in progress", IDEM_HEADER)))
+		return nil, false
+	case ok:
+		M_ac.TpLogInfo("%s [%s] replaying stored response %d, caller: %s",
+			IDEM_HEADER, key, e.Status, req.RemoteAddr)
+		idemReplay(w, e)
+		return nil, false
+	}
+
+	e = &idemEntry{Key: skey, Fingerprint: fp,
+		Expires: now + int64(svc.Idempotency_ttl)}
+	M_idem.add(e)
+
+	return &idemWriter{ResponseWriter: w, entry: e}, true
+}
+
+//Store the recorded response, or release the key if request was not
+//processed (no free context or response aborted), so that it can be retried
+//@param iw recording writer
+func idemEnd(iw *idemWriter) {
+
+	M_idem.mu.Lock()
+	defer M_idem.mu.Unlock()
+
+	e := iw.entry
+
+	if !iw.processed || 0 == iw.status {
+		M_ac.TpLogInfo("%s released, request not processed", IDEM_HEADER)
+		M_idem.remove(e)
+		return
+	}
+
+	//Headers of the transfer are set again on replay
+	iw.header.Del("Content-Length")
+	iw.header.Del("Content-Encoding")
+	iw.header.Del("Vary")
+
+	e.Status = iw.status
+	e.Header = iw.header
+	e.Body = iw.body.Bytes()
+	e.done = true
+
+	M_idem.persist(M_ac, e)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,290 @@
+/**
+ * @brief Per-route rate limiting and concurrency caps
+ *
+ * @file limits.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	RATE_KEY_IP            = "ip"      //Rate limit per client IP
+	RATE_KEY_HEADER        = "header:" //Rate limit per header value, prefix
+	RATE_PRUNE_SIZE        = 10000     //Prune idle buckets when map grows over
+	INFLIGHT_RETRY_DEFAULT = 1         //Retry-After seconds for concurrency limit
+)
+
+//Token bucket
+type tokenBucket struct {
+	tokens float64   //Tokens available
+	last   time.Time //Last refill time
+}
+
+//Route limits state
+type RouteLimiter struct {
+	rate    float64                 //Tokens per second, 0 - no rate limit
+	burst   float64                 //Bucket size
+	key     string                  //Bucket key: empty - route, ip, header:Name
+	mu      sync.Mutex              //Protects buckets
+	buckets map[string]*tokenBucket //Buckets by key
+	slots   chan bool               //In-flight slots, nil - no cap
+}
+
+//Validate limit settings of the route and prepare the limiter
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initLimits(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if svc.Max_body_size < 0 || svc.Max_file_size < 0 || svc.Max_upload_size < 0 {
+		ac.TpLogError("Route [%s]: max_body_size, max_file_size and "+
+			"max_upload_size must not be negative", svc.Url)
+		return fmt.Errorf("Route [%s]: invalid body size limits", svc.Url)
+	}
+
+	if svc.Rate_limit < 0 || svc.Rate_burst < 0 || svc.Max_inflight < 0 {
+		ac.TpLogError("Route [%s]: rate_limit, rate_burst and max_inflight "+
+			"must not be negative", svc.Url)
+		return fmt.Errorf("Route [%s]: invalid limits", svc.Url)
+	}
+
+	if "" != svc.Rate_key && RATE_KEY_IP != svc.Rate_key &&
+		(!strings.HasPrefix(svc.Rate_key, RATE_KEY_HEADER) ||
+			len(svc.Rate_key) == len(RATE_KEY_HEADER)) {
+		ac.TpLogError("Route [%s]: invalid rate_key [%s], expected ip or "+
+			"header:<name>", svc.Url, svc.Rate_key)
+		return fmt.Errorf("Route [%s]: invalid rate_key [%s]", svc.Url, svc.Rate_key)
+	}
+
+	if 0 == svc.Rate_limit && 0 == svc.Max_inflight {
+		svc.Limiter = nil
+		return nil
+	}
+
+	l := RouteLimiter{rate: svc.Rate_limit, key: svc.Rate_key,
+		buckets: make(map[string]*tokenBucket)}
+
+	if svc.Rate_burst > 0 {
+		l.burst = float64(svc.Rate_burst)
+	} else {
+		l.burst = math.Max(1, math.Ceil(svc.Rate_limit))
+	}
+
+	if svc.Max_inflight > 0 {
+		l.slots = make(chan bool, svc.Max_inflight)
+	}
+
+	ac.TpLogInfo("Route [%s]: rate limit %f/s burst %f key [%s] max in-flight %d",
+		svc.Url, l.rate, l.burst, l.key, svc.Max_inflight)
+
+	svc.Limiter = &l
+
+	return nil
+}
+
+//Get the bucket key of the request
+func (l *RouteLimiter) bucketKey(req *http.Request) string {
+
+	switch {
+	case RATE_KEY_IP == l.key:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if nil != err {
+			return req.RemoteAddr
+		}
+		return host
+	case strings.HasPrefix(l.key, RATE_KEY_HEADER):
+		return req.Header.Get(l.key[len(RATE_KEY_HEADER):])
+	}
+
+	return ""
+}
+
+//Take token from the bucket
+//@param key bucket key
+//@return 0 if token taken, or seconds to wait for next token
+func (l *RouteLimiter) take(key string) int {
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	//Drop idle (full) buckets, so that keyed buckets do not grow forever
+	if len(l.buckets) > RATE_PRUNE_SIZE {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return int(math.Ceil((1 - b.tokens) / l.rate))
+}
+
+//Check route limits before dispatch, on limit 429/503 response is generated
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return true if request may continue, then release() must be called when done
+func limitFilter(w http.ResponseWriter, req *http.Request, svc *ServiceMap) bool {
+
+	l := svc.Limiter
+
+	if nil == l {
+		return true
+	}
+
+	if l.rate > 0 {
+		if wait := l.take(l.bucketKey(req)); wait > 0 {
+
+			M_ac.TpLogWarn("URL [%s] rate limit exceeded, retry after %d sec",
+				req.URL, wait)
+
+			w.Header().Set("Retry-After", strconv.Itoa(wait))
+			genHTTPErrRsp(M_ac, svc, w, http.StatusTooManyRequests,
+				atmi.NewCustomATMIError(atmi.TPELIMIT, "Rate limit exceeded"))
+
+			return false
+		}
+	}
+
+	if nil != l.slots {
+		select {
+		case l.slots <- true:
+			break
+		default:
+			M_ac.TpLogWarn("URL [%s] max in-flight calls (%d) reached",
+				req.URL, cap(l.slots))
+
+			w.Header().Set("Retry-After", strconv.Itoa(INFLIGHT_RETRY_DEFAULT))
+			genHTTPErrRsp(M_ac, svc, w, http.StatusServiceUnavailable,
+				atmi.NewCustomATMIError(atmi.TPELIMIT, "Too many concurrent calls"))
+
+			return false
+		}
+	}
+
+	return true
+}
+
+//Get the request body size limit of the route
+//@param svc service map
+//@return max body bytes, 0 - no limit
+func bodyLimit(svc *ServiceMap) int64 {
+
+	if svc.Max_body_size > 0 {
+		return svc.Max_body_size
+	}
+
+	//Uploads are stored on disk, other bodies must fit in XATMI buffer
+	if svc.Fileupload {
+		return 0
+	}
+
+	return atmi.ATMIMsgSizeMax()
+}
+
+//Check the request body size. If Content-Length is known and exceeds the
+//limit, request is rejected with 413 before reading the body, otherwise body
+//reading is limited with http.MaxBytesReader, see isBodyTooLarge()
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return true if request may continue
+func bodyLimitFilter(w http.ResponseWriter, req *http.Request, svc *ServiceMap) bool {
+
+	max := bodyLimit(svc)
+
+	if 0 == max || nil == req.Body {
+		return true
+	}
+
+	if req.ContentLength > max {
+
+		M_ac.TpLogError("URL [%s] body size %d exceeds %d bytes, caller: %s",
+			req.URL, req.ContentLength, max, req.RemoteAddr)
+
+		genHTTPErrRsp(M_ac, svc, w, http.StatusRequestEntityTooLarge,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Request body too large"))
+
+		return false
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, max)
+
+	return true
+}
+
+//Check is the body read error caused by the max_body_size limit
+//@param err read error
+//@return true if body too large
+func isBodyTooLarge(err error) bool {
+
+	var mbe *http.MaxBytesError
+
+	return errors.As(err, &mbe)
+}
+
+//Release in-flight slot taken by limitFilter()
+func (l *RouteLimiter) release() {
+
+	if nil != l && nil != l.slots {
+		<-l.slots
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,393 @@
+/**
+ * @brief HTTP listeners (end-points) of the REST-IN
+ *
+ * @file listeners.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	LISTENER_DEFAULT = "default" //Listener defined by ip/port/tls_* settings
+)
+
+//Context key for listener name in the request
+type listenerCtxKey struct{}
+
+//HTTP listener (end-point) configuration
+type Listener struct {
+	Name          string `json:"name"`
+	Ip            string `json:"ip"`
+	Port          int    `json:"port"`
+	Tls_enable    bool   `json:"tls_enable"`
+	Tls_cert_file string `json:"tls_cert_file"`
+	Tls_key_file  string `json:"tls_key_file"`
+
+	Tls_ca_roots    string `json:"tls_ca_roots"`    //Semicolon separated CA roots
+	Tls_client_auth int    `json:"tls_client_auth"` //0 - none, 1 - require, 2 - if given
+	Tls_min_version string `json:"tls_min_version"` //TLS10, TLS11, TLS12
+
+	//Server tuning, UNSET - global setting is used
+	Read_timeout        int   `json:"read_timeout"`        //Seconds, 0 - none
+	Read_header_timeout int   `json:"read_header_timeout"` //Seconds, 0 - read_timeout
+	Write_timeout       int   `json:"write_timeout"`       //Seconds, 0 - none
+	Idle_timeout        int   `json:"idle_timeout"`        //Seconds, 0 - read_timeout
+	Max_header_bytes    int   `json:"max_header_bytes"`    //0 - Go default (1MB)
+	Http2               *bool `json:"http2"`               //HTTP/2 over TLS, nil - on with TLS
+	H2c                 bool  `json:"h2c"`                 //Cleartext HTTP/2
+
+	server    *http.Server //HTTP server of the end-point
+	tlsConfig *tls.Config  //Resolved TLS settings
+	http2     bool         //Resolved HTTP/2 setting
+}
+
+var M_listeners []*Listener //List of configured listeners
+
+//Parse the 'listeners' config block (JSON array of listeners)
+//@param ac ATMI Context
+//@param cfg JSON config
+//@return error or nil
+func parseListeners(ac *atmi.ATMICtx, cfg []byte) error {
+
+	var listeners []json.RawMessage
+
+	if err := json.Unmarshal(cfg, &listeners); nil != err {
+		ac.TpLogError("Failed to parse listeners: %s", err)
+		return fmt.Errorf("Failed to parse listeners: %s", err)
+	}
+
+	for _, raw := range listeners {
+
+		//Server settings not given are taken from globals, see initServers()
+		l := Listener{Read_timeout: UNSET, Read_header_timeout: UNSET,
+			Write_timeout: UNSET, Idle_timeout: UNSET, Max_header_bytes: UNSET}
+
+		if err := json.Unmarshal(raw, &l); nil != err {
+			ac.TpLogError("Failed to parse listener [%s]: %s", string(raw), err)
+			return fmt.Errorf("Failed to parse listener [%s]: %s", string(raw), err)
+		}
+
+		M_listeners = append(M_listeners, &l)
+	}
+
+	return nil
+}
+
+//Add the listener defined by ip/port/tls_* settings
+//@param ac ATMI Context
+func addDefaultListener(ac *atmi.ATMICtx) {
+
+	l := Listener{Name: LISTENER_DEFAULT, Ip: M_ip, Port: M_port,
+		Tls_enable: TRUE == M_tls_enable, Tls_cert_file: M_tls_cert_file,
+		Tls_key_file: M_tls_key_file, Tls_ca_roots: M_tls_ca_roots,
+		Tls_client_auth: M_tls_client_auth, Tls_min_version: M_tls_min_version,
+		Read_timeout: UNSET, Read_header_timeout: UNSET, Write_timeout: UNSET,
+		Idle_timeout: UNSET, Max_header_bytes: UNSET,
+		H2c: TRUE == M_h2c}
+
+	if UNSET != M_http2 {
+		http2 := TRUE == M_http2
+		l.Http2 = &http2
+	}
+
+	ac.TpLogInfo("Adding default listener ip: %s port: %d", l.Ip, l.Port)
+
+	M_listeners = append(M_listeners, &l)
+}
+
+//Find listener by name
+//@param name listener name
+//@return listener or nil if not found
+func findListener(name string) *Listener {
+
+	for _, l := range M_listeners {
+		if l.Name == name {
+			return l
+		}
+	}
+
+	return nil
+}
+
+//Validate listener settings
+//@param ac ATMI Context
+//@return error or nil
+func validateListeners(ac *atmi.ATMICtx) error {
+
+	if len(M_listeners) == 0 {
+		ac.TpLogError("Invalid config: missing ip (%s) or port (%d) or listeners",
+			M_ip, M_port)
+		return fmt.Errorf("Invalid config: missing ip or port or listeners")
+	}
+
+	names := make(map[string]bool)
+
+	for _, l := range M_listeners {
+
+		if "" == l.Name || names[l.Name] {
+			ac.TpLogError("Invalid config: listener name [%s] empty or duplicate",
+				l.Name)
+			return fmt.Errorf("Invalid config: listener name [%s] empty or duplicate",
+				l.Name)
+		}
+
+		names[l.Name] = true
+
+		if l.Port <= 0 || "" == l.Ip {
+			ac.TpLogError("Invalid config: listener [%s] missing ip (%s) or port (%d)",
+				l.Name, l.Ip, l.Port)
+			return fmt.Errorf("Invalid config: listener [%s] missing ip or port",
+				l.Name)
+		}
+
+		if l.Tls_enable && ("" == l.Tls_cert_file || "" == l.Tls_key_file) {
+			ac.TpLogError("Invalid TLS settings for listener [%s] missing cert "+
+				"(%s) or keyfile (%s) ", l.Name, l.Tls_cert_file, l.Tls_key_file)
+			return fmt.Errorf("Invalid config: listener [%s] missing TLS cert or key file",
+				l.Name)
+		}
+
+		if l.Tls_enable {
+			if err := initListenerTLS(ac, l); nil != err {
+				return err
+			}
+		} else if CLIENT_AUTH_NONE != l.Tls_client_auth {
+			ac.TpLogError("Invalid config: listener [%s] tls_client_auth "+
+				"requires tls_enable", l.Name)
+			return fmt.Errorf("Invalid config: listener [%s] tls_client_auth "+
+				"requires tls_enable", l.Name)
+		}
+
+		//HTTP/2 is offered over TLS, unless disabled explicitly
+		if nil == l.Http2 {
+			l.http2 = l.Tls_enable
+		} else {
+			l.http2 = *l.Http2
+		}
+
+		if l.http2 && !l.Tls_enable {
+			ac.TpLogError("Invalid config: listener [%s] http2 requires "+
+				"tls_enable, use h2c for cleartext", l.Name)
+			return fmt.Errorf("Invalid config: listener [%s] http2 requires "+
+				"tls_enable", l.Name)
+		}
+
+		if l.H2c && l.Tls_enable {
+			ac.TpLogError("Invalid config: listener [%s] h2c is cleartext "+
+				"HTTP/2, use http2 with tls_enable", l.Name)
+			return fmt.Errorf("Invalid config: listener [%s] h2c with tls_enable",
+				l.Name)
+		}
+
+		//Resolve server settings not set for the listener
+		for _, v := range []struct {
+			val    *int
+			global int
+		}{
+			{&l.Read_timeout, M_read_timeout},
+			{&l.Read_header_timeout, M_read_header_timeout},
+			{&l.Write_timeout, M_write_timeout},
+			{&l.Idle_timeout, M_idle_timeout},
+			{&l.Max_header_bytes, M_max_header_bytes},
+		} {
+			if UNSET == *v.val {
+				*v.val = v.global
+			} else if *v.val < 0 {
+				ac.TpLogError("Invalid config: listener [%s] negative "+
+					"timeout or header size", l.Name)
+				return fmt.Errorf("Invalid config: listener [%s] negative "+
+					"timeout or header size", l.Name)
+			}
+		}
+
+		ac.TpLogInfo("Listener [%s]: ip: %s port: %d tls: %t http2: %t h2c: %t "+
+			"read timeout: %d read header timeout: %d write timeout: %d "+
+			"idle timeout: %d max header bytes: %d",
+			l.Name, l.Ip, l.Port, l.Tls_enable, l.http2, l.H2c,
+			l.Read_timeout, l.Read_header_timeout, l.Write_timeout,
+			l.Idle_timeout, l.Max_header_bytes)
+	}
+
+	return nil
+}
+
+//Validate that route is bound to existing listeners
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func validateRouteListeners(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	for _, name := range svc.Listeners {
+		if nil == findListener(name) {
+			ac.TpLogError("Route [%s] bound to unknown listener [%s]",
+				svc.Url, name)
+			return fmt.Errorf("Route [%s] bound to unknown listener [%s]",
+				svc.Url, name)
+		}
+	}
+
+	return nil
+}
+
+//Check is route served by the listener
+//@param listeners listener names bound to route, empty - all
+//@param name listener name
+//@return true if served
+func boundToListener(listeners []string, name string) bool {
+
+	if len(listeners) == 0 {
+		return true
+	}
+
+	for _, l := range listeners {
+		if l == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Get the name of listener which accepted the request
+//@param r HTTP request
+//@return listener name
+func requestListener(r *http.Request) string {
+	name, _ := r.Context().Value(listenerCtxKey{}).(string)
+	return name
+}
+
+//Prepare HTTP servers for the listeners. HTTP/2 over TLS is negotiated by
+//net/http, cleartext HTTP/2 is served by golang.org/x/net/http2/h2c
+//@param ac ATMI Context
+func initServers(ac *atmi.ATMICtx) {
+
+	for _, l := range M_listeners {
+
+		name := l.Name
+
+		var handler http.Handler = &M_handler
+
+		if l.H2c {
+			handler = h2c.NewHandler(handler, &http2.Server{})
+		}
+
+		l.server = &http.Server{Addr: fmt.Sprintf("%s:%d", l.Ip, l.Port),
+			Handler:           handler,
+			TLSConfig:         l.tlsConfig,
+			ReadTimeout:       time.Duration(l.Read_timeout) * time.Second,
+			ReadHeaderTimeout: time.Duration(l.Read_header_timeout) * time.Second,
+			WriteTimeout:      time.Duration(l.Write_timeout) * time.Second,
+			IdleTimeout:       time.Duration(l.Idle_timeout) * time.Second,
+			MaxHeaderBytes:    l.Max_header_bytes,
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), listenerCtxKey{}, name)
+			}}
+
+		//Empty map disables HTTP/2 negotiation on TLS listener
+		if l.Tls_enable && !l.http2 {
+			l.server.TLSNextProto = make(map[string]func(*http.Server,
+				*tls.Conn, http.Handler))
+		}
+	}
+}
+
+//Serve the listener, return when listener is closed
+//@param ac ATMI Context
+//@param l listener
+//@return nil if closed by shutdown, or error
+func runListener(ac *atmi.ATMICtx, l *Listener) error {
+
+	var err error
+
+	ac.TpLog(atmi.LOG_INFO, "Listener [%s] about to listen on: (ip: %s, port: %d) %s",
+		l.Name, l.Ip, l.Port, l.server.Addr)
+
+	if l.Tls_enable {
+		err = l.server.ListenAndServeTLS(l.Tls_cert_file, l.Tls_key_file)
+	} else {
+		err = l.server.ListenAndServe()
+	}
+
+	//Listener closed by shutdown, that is ok
+	if http.ErrServerClosed == err {
+		ac.TpLogWarn("Listener [%s] on %s closed", l.Name, l.server.Addr)
+		return nil
+	}
+
+	ac.TpLogError("Listener [%s] ListenAndServe() failed: %s", l.Name, err)
+
+	return err
+}
+
+//Stop all listeners and wait for in-flight requests
+//@param ac ATMI Context
+//@param ctx deadline for draining
+//@return error if drain did not complete
+func shutdownListeners(ac *atmi.ATMICtx, ctx context.Context) error {
+
+	var wg sync.WaitGroup
+	var ret error
+	var mu sync.Mutex
+
+	for _, l := range M_listeners {
+
+		wg.Add(1)
+
+		go func(l *Listener) {
+			defer wg.Done()
+
+			if err := l.server.Shutdown(ctx); nil != err {
+				ac.TpLogError("Listener [%s] failed to drain: %s", l.Name, err)
+				mu.Lock()
+				ret = err
+				mu.Unlock()
+			}
+		}(l)
+	}
+
+	wg.Wait()
+
+	return ret
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
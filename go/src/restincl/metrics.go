@@ -0,0 +1,393 @@
+/**
+ * @brief Prometheus metrics of the REST-IN
+ *
+ * @file metrics.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Latency histogram buckets, seconds
+var M_metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30, 60}
+
+//Metrics of the route
+type routeMetrics struct {
+	requests map[string]int64 //Counts by "http status|ATMI error"
+	buckets  []int64          //Latency counts per bucket (not cumulative)
+	sum      float64          //Latency sum, seconds
+	count    int64            //Number of requests completed
+	inflight int64            //Requests in progress
+	bytesIn  int64            //Request body bytes
+	bytesOut int64            //Response body bytes
+	uploads  int64            //Files uploaded
+}
+
+//Metrics key, several routes may serve the same URL by different methods
+type metricsKey struct {
+	url    string //Route URL
+	method string //Request method, see metricsMethod()
+}
+
+//Metrics registry
+type metricsRegistry struct {
+	enabled atomic.Bool                  //Set if metrics route is configured (also by reload)
+	mu      sync.Mutex                   //Protects routes
+	routes  map[metricsKey]*routeMetrics //Metrics by route URL and method
+}
+
+var M_metrics = metricsRegistry{routes: make(map[metricsKey]*routeMetrics)}
+
+//Methods labeled as is, others are counted as METRICS_METHOD_OTHER,
+//so that clients cannot grow the label set
+var M_metricsMethods = map[string]bool{http.MethodGet: true,
+	http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true}
+
+const (
+	METRICS_METHOD_OTHER = "OTHER" //Label of non standard methods
+)
+
+//Response writer recording status, size and ATMI error code
+type metricsWriter struct {
+	http.ResponseWriter
+	status   int       //HTTP status sent
+	bytes    int64     //Response bytes sent
+	atmiCode int       //ATMI error code of response
+	bytesIn  int64     //Request body bytes read
+	start    time.Time //Request start time
+	method   string    //Method label of the request
+}
+
+//Request body counting the bytes read
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+func (m *metricsWriter) WriteHeader(code int) {
+	if 0 == m.status {
+		m.status = code
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metricsWriter) Write(b []byte) (int, error) {
+	if 0 == m.status {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(b)
+	m.bytes += int64(n)
+	return n, err
+}
+
+//Flush, if supported by the underlying writer
+func (m *metricsWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Underlying writer, for http.ResponseController
+func (m *metricsWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+//Record ATMI error code of the response
+func (m *metricsWriter) setATMICode(code int) {
+	m.atmiCode = code
+}
+
+//Record the ATMI error code of the response (for metrics and cache)
+//@param w response writer
+//@param code ATMI error code, 0 - succeed
+func setRspATMICode(w http.ResponseWriter, code int) {
+
+	//Writers may be wrapped, e.g. by compression
+	for {
+		if cw, ok := w.(interface{ setATMICode(int) }); ok {
+			cw.setATMICode(code)
+		}
+
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+
+		if !ok {
+			return
+		}
+
+		w = u.Unwrap()
+	}
+}
+
+//Method label of the request
+//@param method HTTP request method
+//@return method or METRICS_METHOD_OTHER
+func metricsMethod(method string) string {
+
+	if M_metricsMethods[method] {
+		return method
+	}
+
+	return METRICS_METHOD_OTHER
+}
+
+//Get metrics of the route, created on first use
+//@param url route URL
+//@param method method label, see metricsMethod()
+func routeMetricsGet(url string, method string) *routeMetrics {
+
+	key := metricsKey{url: url, method: method}
+	rm, ok := M_metrics.routes[key]
+
+	if !ok {
+		rm = &routeMetrics{requests: make(map[string]int64),
+			buckets: make([]int64, len(M_metricsBuckets))}
+		M_metrics.routes[key] = rm
+	}
+
+	return rm
+}
+
+//Start request metrics
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return wrapped writer and request
+func metricsBegin(w http.ResponseWriter, req *http.Request,
+	svc *ServiceMap) (*metricsWriter, *http.Request) {
+
+	mw := &metricsWriter{ResponseWriter: w, start: time.Now(),
+		method: metricsMethod(req.Method)}
+
+	if nil != req.Body {
+		req.Body = countingBody{req.Body, &mw.bytesIn}
+	}
+
+	M_metrics.mu.Lock()
+	routeMetricsGet(svc.Url, mw.method).inflight++
+	M_metrics.mu.Unlock()
+
+	return mw, req
+}
+
+//Complete request metrics
+//@param mw writer returned by metricsBegin()
+//@param svc service map
+func metricsEnd(mw *metricsWriter, svc *ServiceMap) {
+
+	elapsed := time.Since(mw.start).Seconds()
+
+	if 0 == mw.status {
+		mw.status = http.StatusOK
+	}
+
+	M_metrics.mu.Lock()
+	defer M_metrics.mu.Unlock()
+
+	rm := routeMetricsGet(svc.Url, mw.method)
+
+	rm.inflight--
+	rm.requests[fmt.Sprintf("%d|%d", mw.status, mw.atmiCode)]++
+	rm.count++
+	rm.sum += elapsed
+	rm.bytesIn += atomic.LoadInt64(&mw.bytesIn)
+	rm.bytesOut += mw.bytes
+
+	for i, le := range M_metricsBuckets {
+		if elapsed <= le {
+			rm.buckets[i]++
+			break
+		}
+	}
+}
+
+//Count uploaded files of the route
+//@param svc service map
+//@param req HTTP request
+//@param n number of files
+func metricsUploads(svc *ServiceMap, req *http.Request, n int) {
+
+	if !M_metrics.enabled.Load() {
+		return
+	}
+
+	M_metrics.mu.Lock()
+	routeMetricsGet(svc.Url, metricsMethod(req.Method)).uploads += int64(n)
+	M_metrics.mu.Unlock()
+}
+
+//Escape label value
+func metricsLabel(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+//Route and method labels of the metrics key
+func metricsLabels(key metricsKey) string {
+	return fmt.Sprintf("route=\"%s\",method=\"%s\"", metricsLabel(key.url),
+		key.method)
+}
+
+//Write metric header
+func metricsHeader(b *bytes.Buffer, name, mtype, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+//Metrics route handler, route authentication settings apply
+//@param w response writer
+//@param req HTTP request
+//@param svc metrics route
+func metricsRoute(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
+
+	if _, ok := authFilter(w, req, &svc); ok {
+		serveMetrics(w, req)
+	}
+}
+
+//Serve the metrics in Prometheus text exposition format
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+
+	var b bytes.Buffer
+
+	M_metrics.mu.Lock()
+
+	keys := make([]metricsKey, 0, len(M_metrics.routes))
+	for key := range M_metrics.routes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].url != keys[j].url {
+			return keys[i].url < keys[j].url
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	metricsHeader(&b, "restin_requests_total", "counter",
+		"Requests by route, method, HTTP status and ATMI error code.")
+	for _, key := range keys {
+		rm := M_metrics.routes[key]
+		labels := metricsLabels(key)
+		codeKeys := make([]string, 0, len(rm.requests))
+		for k := range rm.requests {
+			codeKeys = append(codeKeys, k)
+		}
+		sort.Strings(codeKeys)
+
+		for _, k := range codeKeys {
+			codes := strings.SplitN(k, "|", 2)
+			fmt.Fprintf(&b, "restin_requests_total{%s,code=\"%s\","+
+				"atmi_error=\"%s\"} %d\n", labels, codes[0], codes[1],
+				rm.requests[k])
+		}
+	}
+
+	metricsHeader(&b, "restin_request_duration_seconds", "histogram",
+		"Request latency by route and method.")
+	for _, key := range keys {
+		rm := M_metrics.routes[key]
+		labels := metricsLabels(key)
+		var cum int64
+		for i, le := range M_metricsBuckets {
+			cum += rm.buckets[i]
+			fmt.Fprintf(&b, "restin_request_duration_seconds_bucket{%s,"+
+				"le=\"%s\"} %d\n", labels,
+				strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(&b, "restin_request_duration_seconds_bucket{%s,"+
+			"le=\"+Inf\"} %d\n", labels, rm.count)
+		fmt.Fprintf(&b, "restin_request_duration_seconds_sum{%s} %s\n",
+			labels, strconv.FormatFloat(rm.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "restin_request_duration_seconds_count{%s} %d\n",
+			labels, rm.count)
+	}
+
+	routeValues := []struct {
+		name, mtype, help string
+		value             func(rm *routeMetrics) int64
+	}{
+		{"restin_inflight_requests", "gauge",
+			"Requests in progress by route and method.",
+			func(rm *routeMetrics) int64 { return rm.inflight }},
+		{"restin_request_bytes_total", "counter",
+			"Request body bytes by route and method.",
+			func(rm *routeMetrics) int64 { return rm.bytesIn }},
+		{"restin_response_bytes_total", "counter",
+			"Response body bytes by route and method.",
+			func(rm *routeMetrics) int64 { return rm.bytesOut }},
+		{"restin_fileupload_files_total", "counter",
+			"Uploaded files by route and method.",
+			func(rm *routeMetrics) int64 { return rm.uploads }},
+	}
+
+	for _, rv := range routeValues {
+		metricsHeader(&b, rv.name, rv.mtype, rv.help)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s{%s} %d\n", rv.name, metricsLabels(key),
+				rv.value(M_metrics.routes[key]))
+		}
+	}
+
+	M_metrics.mu.Unlock()
+
+	workers := poolWorkers()
+	free := len(M_freechan)
+
+	metricsHeader(&b, "restin_pool_workers", "gauge", "XATMI sessions in pool.")
+	fmt.Fprintf(&b, "restin_pool_workers %d\n", workers)
+	metricsHeader(&b, "restin_pool_free", "gauge", "Free XATMI sessions.")
+	fmt.Fprintf(&b, "restin_pool_free %d\n", free)
+	metricsHeader(&b, "restin_pool_busy", "gauge", "Busy XATMI sessions.")
+	fmt.Fprintf(&b, "restin_pool_busy %d\n", workers-free)
+	metricsHeader(&b, "restin_pool_waiting", "gauge",
+		"Requests waiting for free XATMI session.")
+	fmt.Fprintf(&b, "restin_pool_waiting %d\n", atomic.LoadInt64(&M_poolwaiting))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Write(b.Bytes())
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,248 @@
+/**
+ * @brief Mutual TLS - listener TLS settings and client certificate identity
+ *
+ * @file mtls.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"exutil"
+	"fmt"
+	"net/http"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	CLIENT_AUTH_NONE    = 0 //Client certificate not requested
+	CLIENT_AUTH_REQUIRE = 1 //Client certificate required and verified
+	CLIENT_AUTH_IFGIVEN = 2 //Client certificate verified if given
+
+	JSON_CERT_FIELD_DEFAULT = "ClientCert" //JSON key for client cert identity
+)
+
+//Client certificate identity fields, set only by restincl
+var M_certFlds = []int{ubftab.EX_IF_CERTSUBJ, ubftab.EX_IF_CERTISSUER,
+	ubftab.EX_IF_CERTSERIAL, ubftab.EX_IF_CERTSAN}
+
+//Map tls_min_version setting to TLS version constant
+//@param ver version string TLS10/TLS11/TLS12, empty - Go default
+//@return TLS version, error
+func tlsMinVersion(ver string) (uint16, error) {
+
+	switch ver {
+	case "":
+		return 0, nil
+	case "TLS10":
+		return tls.VersionTLS10, nil
+	case "TLS11":
+		return tls.VersionTLS11, nil
+	case "TLS12":
+		return tls.VersionTLS12, nil
+	}
+
+	return 0, fmt.Errorf("Invalid tls_min_version [%s], expected: TLS10,TLS11,TLS12",
+		ver)
+}
+
+//Prepare TLS configuration of the listener
+//@param ac ATMI Context
+//@param l listener
+//@return error or nil
+func initListenerTLS(ac *atmi.ATMICtx, l *Listener) error {
+
+	var cfg tls.Config
+	var err error
+
+	if cfg.MinVersion, err = tlsMinVersion(l.Tls_min_version); nil != err {
+		ac.TpLogError("Listener [%s]: %s", l.Name, err)
+		return err
+	}
+
+	switch l.Tls_client_auth {
+	case CLIENT_AUTH_NONE:
+		cfg.ClientAuth = tls.NoClientCert
+	case CLIENT_AUTH_REQUIRE:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case CLIENT_AUTH_IFGIVEN:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		ac.TpLogError("Listener [%s]: invalid tls_client_auth %d, expected 0, 1 or 2",
+			l.Name, l.Tls_client_auth)
+		return fmt.Errorf("Listener [%s]: invalid tls_client_auth %d",
+			l.Name, l.Tls_client_auth)
+	}
+
+	//Load roots if any...
+	if "" != l.Tls_ca_roots {
+		if err := exutil.LoadRootCAs(ac, l.Tls_ca_roots); nil != err {
+			ac.TpLogError("Listener [%s]: failed to load CA roots: %s",
+				l.Name, err.Error())
+			return err
+		}
+
+		cfg.ClientCAs = exutil.MRootCAs
+	} else if CLIENT_AUTH_NONE != l.Tls_client_auth {
+		//Any public CA could issue accepted client certificate
+		ac.TpLogError("Listener [%s]: tls_client_auth requires tls_ca_roots",
+			l.Name)
+		return fmt.Errorf("Listener [%s]: tls_client_auth requires tls_ca_roots",
+			l.Name)
+	}
+
+	ac.TpLogInfo("Listener [%s]: TLS CA Roots: [%s] Client Auth: %v Min version: %v",
+		l.Name, l.Tls_ca_roots, cfg.ClientAuth, cfg.MinVersion)
+
+	l.tlsConfig = &cfg
+
+	return nil
+}
+
+//Get verified client certificate of the request
+//@param req HTTP request
+//@return client certificate or nil if not verified/not given
+func clientCert(req *http.Request) *x509.Certificate {
+
+	if nil == req.TLS || len(req.TLS.VerifiedChains) == 0 ||
+		len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return req.TLS.VerifiedChains[0][0]
+}
+
+//Get the Subject Alternative Names of certificate
+//@param cert certificate
+//@return SANs in form TYPE:value
+func certSANs(cert *x509.Certificate) []string {
+
+	var sans []string
+
+	for _, v := range cert.DNSNames {
+		sans = append(sans, "DNS:"+v)
+	}
+
+	for _, v := range cert.EmailAddresses {
+		sans = append(sans, "email:"+v)
+	}
+
+	for _, v := range cert.IPAddresses {
+		sans = append(sans, "IP:"+v.String())
+	}
+
+	for _, v := range cert.URIs {
+		sans = append(sans, "URI:"+v.String())
+	}
+
+	return sans
+}
+
+//Load client certificate identity into UBF buffer
+//EX_IF_CERTSUBJ, EX_IF_CERTISSUER, EX_IF_CERTSERIAL, EX_IF_CERTSAN (multi occ)
+//Fields sent by the client are removed, so that identity cannot be forged
+//@param ac ATMI Context
+//@param req HTTP request
+//@param bufu UBF buffer
+//@return UBF error or nil
+func loadClientCertUBF(ac *atmi.ATMICtx, req *http.Request,
+	bufu *atmi.TypedUBF) atmi.UBFError {
+
+	if errU := bufu.BDelete(M_certFlds); nil != errU &&
+		atmi.BNOTPRES != errU.Code() {
+		return errU
+	}
+
+	cert := clientCert(req)
+
+	if nil == cert {
+		return nil
+	}
+
+	ac.TpLogInfo("Client certificate: subject [%s] issuer [%s]",
+		cert.Subject.String(), cert.Issuer.String())
+
+	if errU := bufu.BChg(ubftab.EX_IF_CERTSUBJ, 0,
+		cert.Subject.String()); nil != errU {
+		return errU
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_CERTISSUER, 0,
+		cert.Issuer.String()); nil != errU {
+		return errU
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_CERTSERIAL, 0,
+		fmt.Sprintf("%X", cert.SerialNumber)); nil != errU {
+		return errU
+	}
+
+	for _, san := range certSANs(cert) {
+		if errU := bufu.BAdd(ubftab.EX_IF_CERTSAN, san); nil != errU {
+			return errU
+		}
+	}
+
+	return nil
+}
+
+//JSON key of client certificate identity
+//@param svc service map
+//@return key name
+func jsonCertKey(svc *ServiceMap) string {
+
+	if "" != svc.JsonCertField {
+		return svc.JsonCertField
+	}
+
+	return JSON_CERT_FIELD_DEFAULT
+}
+
+//Client certificate identity for JSON header block
+//@param req HTTP request
+//@return identity object or nil if there is no verified client certificate
+func clientCertJSON(req *http.Request) map[string]interface{} {
+
+	cert := clientCert(req)
+
+	if nil == cert {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"Subject": cert.Subject.String(),
+		"Issuer":  cert.Issuer.String(),
+		"Serial":  fmt.Sprintf("%X", cert.SerialNumber),
+		"SAN":     certSANs(cert)}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
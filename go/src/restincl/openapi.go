@@ -0,0 +1,539 @@
+/**
+ * @brief OpenAPI 3 document generated from route configuration
+ *
+ * @file openapi.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	OPENAPI_VERSION       = "3.0.3"
+	OPENAPI_TITLE_DEFAULT = "Enduro/X REST-IN"
+	OPENAPI_DOC_VERSION   = "1.0"
+	OPENAPI_OMITTED_EXT   = "x-omitted-routes" //Routes not described
+)
+
+var M_openapi_url string   //OpenAPI document end-point, empty - none
+var M_openapi_title string //Title of the API in the document
+var M_openapi atomic.Value //Generated document ([]byte), replaced by reload
+
+//Key name in errfmt_json_* format string, e.g. "error_code":%d
+var M_errfmtKeyRex = regexp.MustCompile("^\\s*\"([^\"]+)\"\\s*:")
+
+//Generic JSON schema object
+type jsonSchema map[string]interface{}
+
+//Get the JSON key name from errfmt_json_code/errfmt_json_msg format
+//@param format format string
+//@return key name or empty if not parsable
+func errfmtJSONKey(format string) string {
+
+	m := M_errfmtKeyRex.FindStringSubmatch(format)
+
+	if nil == m {
+		return ""
+	}
+
+	return m[1]
+}
+
+//Build schema for the JSON value, got from VIEW to JSON conversion
+//@param v value decoded with json.Number
+//@return schema
+func valueSchema(v interface{}) jsonSchema {
+
+	switch t := v.(type) {
+	case json.Number:
+		if strings.ContainsAny(t.String(), ".eE") {
+			return jsonSchema{"type": "number"}
+		}
+		return jsonSchema{"type": "integer"}
+	case string:
+		return jsonSchema{"type": "string"}
+	case bool:
+		return jsonSchema{"type": "boolean"}
+	case []interface{}:
+		items := jsonSchema{"type": "string"}
+		if len(t) > 0 {
+			items = valueSchema(t[0])
+		}
+		return jsonSchema{"type": "array", "items": items}
+	}
+
+	return jsonSchema{"type": "object"}
+}
+
+//Resolve VIEW layout via view tables. The empty VIEW buffer is converted
+//to JSON and field types are taken from the (null) values
+//@param ac ATMI Context
+//@param view VIEW name
+//@return schema of the VIEW object, error
+func viewSchema(ac *atmi.ATMICtx, view string) (jsonSchema, error) {
+
+	bufv, errA := ac.NewVIEW(view, 0)
+
+	if nil != errA {
+		return nil, fmt.Errorf("Failed to alloc VIEW/[%s]: %s", view, errA.Error())
+	}
+
+	js, errA := bufv.TpVIEWToJSON(0)
+
+	if nil != errA {
+		return nil, fmt.Errorf("Failed to convert VIEW/[%s] to JSON: %s",
+			view, errA.Error())
+	}
+
+	var obj map[string]map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(js))
+	dec.UseNumber()
+
+	if err := dec.Decode(&obj); nil != err {
+		return nil, fmt.Errorf("Failed to parse VIEW/[%s] JSON: %s", view, err.Error())
+	}
+
+	props := jsonSchema{}
+
+	for name, v := range obj[view] {
+		props[name] = valueSchema(v)
+	}
+
+	return jsonSchema{"type": "object", "properties": props}, nil
+}
+
+//OpenAPI document builder
+type openAPIDoc struct {
+	ac      *atmi.ATMICtx
+	paths   map[string]jsonSchema
+	schemas map[string]interface{}
+	secs    map[string]interface{}
+	omitted []string //Routes which cannot be described, e.g. regexp URLs
+}
+
+//Reference VIEW schema, resolve it on first use
+//@param view VIEW name
+//@return schema reference, error
+func (d *openAPIDoc) viewRef(view string) (jsonSchema, error) {
+
+	if _, ok := d.schemas[view]; !ok {
+
+		s, err := viewSchema(d.ac, view)
+
+		if nil != err {
+			return nil, err
+		}
+
+		d.schemas[view] = s
+	}
+
+	return jsonSchema{"$ref": "#/components/schemas/" + view}, nil
+}
+
+//Schema of the JSON object wrapping the VIEW, i.e. {"VIEW":{...}}
+//@param view VIEW name, empty - any VIEW
+//@return schema, error
+func (d *openAPIDoc) viewObject(view string) (jsonSchema, error) {
+
+	if "" == view {
+		return jsonSchema{"type": "object",
+			"description": "JSON object with single VIEW name key"}, nil
+	}
+
+	ref, err := d.viewRef(view)
+
+	if nil != err {
+		return nil, err
+	}
+
+	return jsonSchema{"type": "object",
+		"properties": jsonSchema{view: ref}}, nil
+}
+
+//Media type and schema of the request/response body by conversion mode
+//@param svc service map
+//@param view VIEW name for json2view
+//@return media type, schema, error
+func (d *openAPIDoc) bodySchema(svc *ServiceMap, view string) (string, jsonSchema, error) {
+
+	switch svc.Conv_int {
+	case CONV_JSON2UBF:
+		return "application/json", jsonSchema{"type": "object",
+			"description": "UBF fields, keyed by field name"}, nil
+	case CONV_XML2UBF:
+		return "application/xml", jsonSchema{"type": "object",
+			"description": "UBF fields, elements named by field name"}, nil
+	case CONV_JSON:
+		return "application/json", jsonSchema{"type": "object"}, nil
+	case CONV_JSON2VIEW:
+		s, err := d.viewObject(view)
+		return "application/json", s, err
+	case CONV_TEXT:
+		return "text/plain", jsonSchema{"type": "string"}, nil
+	case CONV_RAW:
+		return "application/octet-stream",
+			jsonSchema{"type": "string", "format": "binary"}, nil
+	}
+
+	return "*/*", jsonSchema{"type": "string", "format": "binary"}, nil
+}
+
+//Error response schema by errors mode
+//@param svc service map
+//@return media type, schema (nil - no body), error
+func (d *openAPIDoc) errorSchema(svc *ServiceMap) (string, jsonSchema, error) {
+
+	switch svc.Errors_int {
+	case ERRORS_JSON:
+		props := jsonSchema{}
+		if key := errfmtJSONKey(svc.Errfmt_json_code); "" != key {
+			props[key] = jsonSchema{"type": "integer"}
+		}
+		if key := errfmtJSONKey(svc.Errfmt_json_msg); "" != key {
+			props[key] = jsonSchema{"type": "string"}
+		}
+		return "application/json", jsonSchema{"type": "object",
+			"properties": props}, nil
+	case ERRORS_JSON2UBF:
+		return "application/json", jsonSchema{"type": "object",
+			"properties": jsonSchema{
+				"EX_IF_ECODE": jsonSchema{"type": "integer"},
+				"EX_IF_EMSG":  jsonSchema{"type": "string"}}}, nil
+	case ERRORS_JSON2VIEW:
+		if "" != svc.Errfmt_view_rsp {
+			s, err := d.viewObject(svc.Errfmt_view_rsp)
+			return "application/json", s, err
+		}
+		return "application/json", jsonSchema{"type": "object",
+			"description": fmt.Sprintf("Request VIEW with error code in [%s] "+
+				"and message in [%s]", svc.Errfmt_view_code,
+				svc.Errfmt_view_msg)}, nil
+	case ERRORS_PROBLEM:
+		return PROBLEM_CONTENT_TYPE, jsonSchema{"type": "object",
+			"properties": jsonSchema{
+				"type":         jsonSchema{"type": "string"},
+				"title":        jsonSchema{"type": "string"},
+				"status":       jsonSchema{"type": "integer"},
+				"detail":       jsonSchema{"type": "string"},
+				"instance":     jsonSchema{"type": "string"},
+				"atmi_code":    jsonSchema{"type": "integer"},
+				"error_source": jsonSchema{"type": "string"},
+				"request_id":   jsonSchema{"type": "string"}}}, nil
+	case ERRORS_XML:
+		return "application/xml", jsonSchema{"type": "object",
+			"description": fmt.Sprintf("Response document with [%s] and [%s] "+
+				"elements", svc.Errfmt_xml_code, svc.Errfmt_xml_msg)}, nil
+	case ERRORS_TEXT, ERRORS_RAW:
+		return "text/plain", jsonSchema{"type": "string"}, nil
+	}
+
+	return "", nil, nil
+}
+
+//Register security scheme of the route
+//@param svc service map
+//@return security requirement, nil if route has no auth
+func (d *openAPIDoc) security(svc *ServiceMap) []interface{} {
+
+	var name string
+	var scheme jsonSchema
+
+	switch svc.Auth_int {
+	case AUTH_BASIC:
+		name = "basic"
+		scheme = jsonSchema{"type": "http", "scheme": "basic"}
+	case AUTH_APIKEY:
+		name = "apikey_" + svc.Apikey_header
+		scheme = jsonSchema{"type": "apiKey", "in": "header",
+			"name": svc.Apikey_header}
+	case AUTH_JWT:
+		name = "jwt"
+		scheme = jsonSchema{"type": "http", "scheme": "bearer",
+			"bearerFormat": "JWT"}
+	default:
+		return nil
+	}
+
+	d.secs[name] = scheme
+
+	return []interface{}{jsonSchema{name: []string{}}}
+}
+
+//Build operation object of the route
+//@param svc service map
+//@param method HTTP method
+//@return operation, error
+func (d *openAPIDoc) operation(svc *ServiceMap, method string) (jsonSchema, error) {
+
+	op := jsonSchema{"summary": fmt.Sprintf("XATMI service %s", svc.Svc)}
+
+	if CONV_EXT == svc.Conv_int {
+		op["summary"] = fmt.Sprintf("External service %s", svc.Svc)
+	}
+
+	var params []interface{}
+	for _, p := range svc.Pathparams {
+		params = append(params, jsonSchema{"name": p.Name, "in": "path",
+			"required": true, "schema": jsonSchema{"type": "string"}})
+	}
+
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if http.MethodGet != method && http.MethodHead != method &&
+		http.MethodDelete != method {
+
+		media, schema, err := d.bodySchema(svc, svc.Reqview)
+
+		if nil != err {
+			return nil, err
+		}
+
+		if svc.Fileupload {
+			media = "multipart/form-data"
+			schema = jsonSchema{"type": "object"}
+		}
+
+		op["requestBody"] = jsonSchema{"content": jsonSchema{
+			media: jsonSchema{"schema": schema}}}
+	}
+
+	rspView := svc.Rspview
+	if "" == rspView {
+		rspView = svc.Reqview
+	}
+
+	media, schema, err := d.bodySchema(svc, rspView)
+
+	if nil != err {
+		return nil, err
+	}
+
+	rsps := jsonSchema{"200": jsonSchema{"description": "Service response",
+		"content": jsonSchema{media: jsonSchema{"schema": schema}}}}
+
+	errMedia, errSchema, err := d.errorSchema(svc)
+
+	if nil != err {
+		return nil, err
+	}
+
+	errRsp := jsonSchema{"description": "XATMI error"}
+
+	if nil != errSchema {
+		errRsp["content"] = jsonSchema{errMedia: jsonSchema{"schema": errSchema}}
+	}
+
+	if ERRORS_HTTP == svc.Errors_int || ERRORS_PROBLEM == svc.Errors_int {
+		//Each mapped HTTP status is the possible error response
+		for _, code := range svc.Errors_fmt_http_map {
+			if http.StatusOK != code {
+				rsps[strconv.Itoa(code)] = errRsp
+			}
+		}
+	} else {
+		rsps["default"] = errRsp
+	}
+
+	if sec := d.security(svc); nil != sec {
+		op["security"] = sec
+		rsps["401"] = jsonSchema{"description": "Authentication required"}
+		if len(svc.Auth_allow) > 0 || "" != svc.Jwt_aud {
+			rsps["403"] = jsonSchema{"description": "Principal not allowed"}
+		}
+	}
+
+	if svc.Rate_limit > 0 {
+		rsps["429"] = jsonSchema{"description": "Rate limit exceeded"}
+	}
+
+	if svc.Max_inflight > 0 || svc.Pool_wait_timeout > 0 {
+		rsps["503"] = jsonSchema{"description": "Service busy"}
+	}
+
+	op["responses"] = rsps
+
+	return op, nil
+}
+
+//Add route to document
+//@param svc service map
+//@param methods methods to document, empty - route accepts any method, thus
+//	common methods (see M_corsMethodsDefault) are documented
+//@return error
+func (d *openAPIDoc) addRoute(svc *ServiceMap, methods []string) error {
+
+	if CONV_STATIC == svc.Conv_int || CONV_METRICS == svc.Conv_int ||
+		CONV_WEBSOCKET == svc.Conv_int || CONV_SSE == svc.Conv_int {
+		return nil
+	}
+
+	//Regexp URLs cannot be expressed as OpenAPI paths, listed in document
+	if "regexp" == svc.Format || "r" == svc.Format {
+		d.ac.TpLogWarn("OpenAPI: regexp route [%s] cannot be described, "+
+			"listed in %s", svc.Url, OPENAPI_OMITTED_EXT)
+		d.omitted = append(d.omitted, svc.Url)
+		return nil
+	}
+
+	path, ok := d.paths[svc.Url]
+
+	if !ok {
+		path = jsonSchema{}
+		d.paths[svc.Url] = path
+	}
+
+	anyMethod := len(methods) == 0
+
+	if anyMethod {
+		methods = M_corsMethodsDefault
+	}
+
+	for _, method := range methods {
+
+		op, err := d.operation(svc, method)
+
+		if nil != err {
+			return fmt.Errorf("OpenAPI: route [%s]: %s", svc.Url, err.Error())
+		}
+
+		if anyMethod {
+			op["description"] = "Route accepts any HTTP method"
+		}
+
+		path[strings.ToLower(method)] = op
+	}
+
+	return nil
+}
+
+//Generate OpenAPI document from the configured routes
+//@param ac ATMI Context
+//@param h route handler
+//@return document, error
+func genOpenAPI(ac *atmi.ATMICtx, h *RegexpHandler) ([]byte, error) {
+
+	d := openAPIDoc{ac: ac, paths: make(map[string]jsonSchema),
+		schemas: make(map[string]interface{}),
+		secs:    make(map[string]interface{})}
+
+	//Sort keys, so that generation is stable
+	var keys []string
+	for key := range h.urlMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		svc := h.urlMap[key]
+
+		//Method bound routes are keyed per method, see routeMethodKey()
+		var methods []string
+		if len(svc.Methods) > 0 {
+			methods = []string{strings.SplitN(key, " ", 2)[0]}
+		}
+
+		if err := d.addRoute(&svc, methods); nil != err {
+			ac.TpLogError(err.Error())
+			return nil, err
+		}
+	}
+
+	for _, r := range h.regexpRoutes {
+
+		if err := d.addRoute(&r.svc, r.svc.Methods); nil != err {
+			ac.TpLogError(err.Error())
+			return nil, err
+		}
+	}
+
+	doc := jsonSchema{
+		"openapi": OPENAPI_VERSION,
+		"info": jsonSchema{"title": M_openapi_title,
+			"version": OPENAPI_DOC_VERSION},
+		"paths": d.paths,
+	}
+
+	if len(d.omitted) > 0 {
+		doc[OPENAPI_OMITTED_EXT] = d.omitted
+	}
+
+	components := jsonSchema{}
+
+	if len(d.schemas) > 0 {
+		components["schemas"] = d.schemas
+	}
+
+	if len(d.secs) > 0 {
+		components["securitySchemes"] = d.secs
+	}
+
+	if len(components) > 0 {
+		doc["components"] = components
+	}
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+
+	if nil != err {
+		ac.TpLogError("Failed to build OpenAPI document: %s", err.Error())
+		return nil, err
+	}
+
+	ac.TpLogInfo("OpenAPI document generated, %d paths, %d bytes",
+		len(d.paths), len(out))
+
+	return out, nil
+}
+
+//Serve the OpenAPI document
+//@param w response writer
+//@param req request
+func serveOpenAPI(w http.ResponseWriter, req *http.Request) {
+
+	//Document is replaced by configuration reload
+	doc, _ := M_openapi.Load().([]byte)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
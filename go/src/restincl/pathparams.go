@@ -0,0 +1,224 @@
+/**
+ * @brief URL template & named path parameter support
+ *
+ * @file pathparams.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Template parameter in URL, e.g. /customers/{custId}
+var M_templateParamRex = regexp.MustCompile("\\{([A-Za-z_][A-Za-z0-9_]*)\\}")
+
+//Path parameter, captured from URL template or regexp named group
+type PathParam struct {
+	Name  string //Name of the group in the pattern
+	Field string //Target UBF field or JSON key
+	Fldid int    //Resolved UBF field id (for UBF buffers)
+}
+
+//Check is URL given as template i.e. contains {name} parameters
+//@param url route URL
+//@return true if template
+func isTemplateURL(url string) bool {
+	return M_templateParamRex.MatchString(url)
+}
+
+//Convert URL template to anchored regexp, each {name} parameter is converted
+//to named group matching single path segment
+//@param url URL template, e.g. /customers/{custId}/accounts/{acct}
+//@return regexp string
+func templateToRegexp(url string) string {
+
+	var out strings.Builder
+	last := 0
+
+	out.WriteString("^")
+
+	for _, m := range M_templateParamRex.FindAllStringSubmatchIndex(url, -1) {
+		out.WriteString(regexp.QuoteMeta(url[last:m[0]]))
+		out.WriteString(fmt.Sprintf("(?P<%s>[^/]+)", url[m[2]:m[3]]))
+		last = m[1]
+	}
+
+	out.WriteString(regexp.QuoteMeta(url[last:]))
+	out.WriteString("$")
+
+	return out.String()
+}
+
+//Check can path parameters be passed to service in the conversion mode
+//@param conv conversion mode
+//@return true if UBF or JSON buffer is built from the request
+func isPathParamConv(conv int) bool {
+	return CONV_JSON2UBF == conv || CONV_EXT == conv ||
+		CONV_XML2UBF == conv || CONV_JSON == conv
+}
+
+//Resolve path parameters of the route from the named groups of the pattern
+//Parameter is mapped to field with the same name, unless remapped by 'pathfields'
+//URL template routes with conversion not taking path parameters are rejected,
+//for regexp routes named groups are just not loaded (warning is logged)
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func resolvePathParams(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Pathparams = nil
+
+	if nil == svc.Pattern {
+		return nil
+	}
+
+	for _, name := range svc.Pattern.SubexpNames() {
+
+		if "" == name {
+			continue
+		}
+
+		if !isPathParamConv(svc.Conv_int) {
+
+			if "template" == svc.Format || "t" == svc.Format {
+				ac.TpLogError("Route [%s]: path parameters not supported "+
+					"for conv [%s]", svc.Url, svc.Conv)
+				return fmt.Errorf("Route [%s]: path parameters not supported "+
+					"for conv [%s]", svc.Url, svc.Conv)
+			}
+
+			ac.TpLogWarn("Route [%s]: named group [%s] not loaded for conv [%s]",
+				svc.Url, name, svc.Conv)
+			continue
+		}
+
+		param := PathParam{Name: name, Field: name}
+
+		if fld, ok := svc.Pathfields[name]; ok {
+			param.Field = fld
+		}
+
+		if CONV_JSON2UBF == svc.Conv_int || CONV_EXT == svc.Conv_int ||
+			CONV_XML2UBF == svc.Conv_int {
+
+			fldid, errU := ac.BFldId(param.Field)
+
+			if nil != errU || fldid <= 0 {
+				ac.TpLogError("Route [%s]: path parameter [%s] field [%s] not found",
+					svc.Url, name, param.Field)
+				return fmt.Errorf("Route [%s]: path parameter [%s] field [%s] not found",
+					svc.Url, name, param.Field)
+			}
+
+			param.Fldid = fldid
+		}
+
+		ac.TpLogInfo("Route [%s]: path parameter [%s] -> [%s]",
+			svc.Url, param.Name, param.Field)
+
+		svc.Pathparams = append(svc.Pathparams, param)
+	}
+
+	return nil
+}
+
+//Get path parameter values of the request
+//@param svc service map
+//@param req HTTP request
+//@return map of parameter name -> value
+func pathParamValues(svc *ServiceMap, req *http.Request) map[string]string {
+
+	ret := make(map[string]string)
+
+	if len(svc.Pathparams) == 0 {
+		return ret
+	}
+
+	match := svc.Pattern.FindStringSubmatch(req.URL.Path)
+
+	if nil == match {
+		return ret
+	}
+
+	for i, name := range svc.Pattern.SubexpNames() {
+		if "" != name {
+			ret[name] = match[i]
+		}
+	}
+
+	return ret
+}
+
+//Load path parameters in UBF buffer
+//@param ac ATMI Context
+//@param svc service map
+//@param req HTTP request
+//@param bufu UBF buffer
+//@return UBF error or nil
+func loadPathParamsUBF(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	bufu *atmi.TypedUBF) atmi.UBFError {
+
+	values := pathParamValues(svc, req)
+
+	for _, param := range svc.Pathparams {
+
+		value, ok := values[param.Name]
+
+		if !ok {
+			continue
+		}
+
+		ac.TpLogDebug("Path parameter [%s] field [%s] value [%s]",
+			param.Name, param.Field, value)
+
+		//Values sent by client in the same field are replaced
+		if errU := bufu.BDelete([]int{param.Fldid}); nil != errU &&
+			atmi.BNOTPRES != errU.Code() {
+			ac.TpLogError("Failed to delete path parameter [%s] field [%s]: %s",
+				param.Name, param.Field, errU.Error())
+			return errU
+		}
+
+		if errU := bufu.BChg(param.Fldid, 0, value); nil != errU {
+			ac.TpLogError("Failed to set path parameter [%s] field [%s]: %s",
+				param.Name, param.Field, errU.Error())
+			return errU
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,115 @@
+/**
+ * @brief RFC 7807 problem details error responses
+ *
+ * @file problem.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	PROBLEM_TYPE_DEFAULT = "about:blank"              //Title is HTTP status text
+	PROBLEM_CONTENT_TYPE = "application/problem+json" //Media type of problem details
+	REQUEST_ID_HEADER    = "X-Request-Id"             //Response header of request id
+)
+
+//Problem details of the error response, with XATMI extension members
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	AtmiCode  int    `json:"atmi_code"`    //XATMI error code
+	ErrSrc    string `json:"error_source"` //See ERRSRC_* constants
+	RequestId string `json:"request_id"`
+}
+
+//Get request id of the response. Id (UUID) is generated and set in
+//X-Request-Id header, if not set already
+//@param w response writer
+//@return request id
+func requestID(w http.ResponseWriter) string {
+
+	if id := w.Header().Get(REQUEST_ID_HEADER); "" != id {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	//Version 4, variant RFC 4122
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	w.Header().Set(REQUEST_ID_HEADER, id)
+
+	return id
+}
+
+//Generate problem details document
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param httpCode HTTP status code
+//@param err error code and message
+//@param errSrc error source
+//@return JSON document
+func genProblem(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	httpCode int, err atmi.ATMIError, errSrc string) []byte {
+
+	id := requestID(w)
+
+	p := problemDetails{Type: svc.Problem_type, Title: http.StatusText(httpCode),
+		Status: httpCode, Detail: err.Message(), Instance: "urn:uuid:" + id,
+		AtmiCode: err.Code(), ErrSrc: errSrc, RequestId: id}
+
+	rsp, errJ := json.Marshal(&p)
+
+	if nil != errJ {
+		ac.TpLogError("Failed to build problem details: %s", errJ.Error())
+		return []byte("{}")
+	}
+
+	ac.TpLogWarn("Request [%s] problem: http %d tp %d src [%s]", id,
+		httpCode, err.Code(), errSrc)
+
+	return rsp
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,330 @@
+/**
+ * @brief Asynchronous calls through persistent queues, reply status
+ *
+ * @file queue.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	QUEUE_MSGID_HEADER  = "Queue-Msgid"  //Message id of enqueued request
+	QUEUE_CORRID_HEADER = "Queue-Corrid" //Correlation id of enqueued request
+	QUEUE_CORRID_PARAM  = "corrid"       //Status route query parameter
+)
+
+//Validate queue settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initQueue(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Queue && !svc.Queue_status {
+		return nil
+	}
+
+	if "" == svc.Qspace {
+		ac.TpLogError("Route [%s]: qspace not set", svc.Url)
+		return fmt.Errorf("Route [%s]: qspace not set", svc.Url)
+	}
+
+	if !isCallConv(svc.Conv_int) ||
+		svc.Echo || svc.Fileupload || svc.Download_conv || svc.Upload_conv ||
+		svc.Cache_ttl > 0 || svc.Transaction {
+		ac.TpLogError("Route [%s]: queue not supported for conv [%s], echo, "+
+			"fileupload, download_conv, upload_conv, cache_ttl or transaction",
+			svc.Url, svc.Conv)
+		return fmt.Errorf("Route [%s]: queue not supported for conv [%s], echo, "+
+			"fileupload, download_conv, upload_conv, cache_ttl or transaction",
+			svc.Url, svc.Conv)
+	}
+
+	if svc.Queue_status {
+
+		if "" != svc.Queue || svc.Asynccall || "" == svc.Reply_queue {
+			ac.TpLogError("Route [%s]: queue_status requires reply_queue and "+
+				"cannot be used with queue or async", svc.Url)
+			return fmt.Errorf("Route [%s]: queue_status requires reply_queue and "+
+				"cannot be used with queue or async", svc.Url)
+		}
+
+		if CONV_JSON2VIEW == svc.Conv_int {
+			ac.TpLogError("Route [%s]: queue_status not supported for conv [%s]",
+				svc.Url, svc.Conv)
+			return fmt.Errorf("Route [%s]: queue_status not supported for conv [%s]",
+				svc.Url, svc.Conv)
+		}
+
+		ac.TpLogInfo("Route [%s]: replies dequeued from [%s/%s] failures [%s]",
+			svc.Url, svc.Qspace, svc.Reply_queue, svc.Failure_queue)
+
+		return nil
+	}
+
+	if !svc.Asynccall {
+		ac.TpLogError("Route [%s]: queue requires async", svc.Url)
+		return fmt.Errorf("Route [%s]: queue requires async", svc.Url)
+	}
+
+	ac.TpLogInfo("Route [%s]: requests enqueued to [%s/%s] reply [%s] "+
+		"failure [%s]", svc.Url, svc.Qspace, svc.Queue, svc.Reply_queue,
+		svc.Failure_queue)
+
+	return nil
+}
+
+//Generate correlation id of the request
+//@return correlation id (hex string, TMCORRIDLEN chars)
+func queueCorrid() (string, error) {
+
+	b := make([]byte, atmi.TMCORRIDLEN/2)
+
+	if _, err := rand.Read(b); nil != err {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+//Enqueue the request to the route queue. Message and correlation ids are
+//returned in response headers
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param buf request buffer
+//@return ATMI error or nil
+func queueEnqueue(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	buf atmi.TypedBuffer) atmi.ATMIError {
+
+	var ctl atmi.TPQCTL
+
+	corrid, err := queueCorrid()
+
+	if nil != err {
+		ac.TpLogError("Failed to generate correlation id: %s", err.Error())
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			"Failed to generate correlation id")
+	}
+
+	copy(ctl.Corrid[:], corrid)
+	ctl.Flags = atmi.TPQCORRID
+
+	if "" != svc.Reply_queue {
+		ctl.Replyqueue = svc.Reply_queue
+		ctl.Flags |= atmi.TPQREPLYQ
+	}
+
+	if "" != svc.Failure_queue {
+		ctl.Failurequeue = svc.Failure_queue
+		ctl.Flags |= atmi.TPQFAILUREQ
+	}
+
+	if errA := ac.TpEnqueue(svc.Qspace, svc.Queue, &ctl, buf, 0); nil != errA {
+		ac.TpLogError("Failed to enqueue to [%s/%s]: %s (diagnostic %d: %s)",
+			svc.Qspace, svc.Queue, errA.Message(), ctl.Diagnostic, ctl.Diagmsg)
+		return errA
+	}
+
+	msgid := hex.EncodeToString(ctl.Msgid[:])
+
+	ac.TpLogInfo("Enqueued to [%s/%s] msgid [%s] corrid [%s]",
+		svc.Qspace, svc.Queue, msgid, corrid)
+
+	w.Header().Set(QUEUE_MSGID_HEADER, msgid)
+	w.Header().Set(QUEUE_CORRID_HEADER, corrid)
+
+	return nil
+}
+
+//Allocate buffer for dequeued reply, by route conversion
+//@param ac ATMI Context
+//@param svc service map
+//@return buffer or ATMI error
+func queueRspBuf(ac *atmi.ATMICtx, svc *ServiceMap) (atmi.TypedBuffer,
+	atmi.ATMIError) {
+
+	switch svc.Conv_int {
+	case CONV_TEXT:
+		return ac.NewString("")
+	case CONV_RAW:
+		return ac.NewCarray([]byte{})
+	case CONV_JSON:
+		return ac.NewJSON([]byte("{}"))
+	}
+
+	return ac.NewUBF(atmi.ATMIMsgSizeMax())
+}
+
+//Dequeue message by correlation id
+//@param ac ATMI Context
+//@param svc service map
+//@param qname queue name
+//@param corrid correlation id
+//@param peek if true, message is read but left in the queue
+//@return buffer (nil if no message) or ATMI error
+func queueDequeue(ac *atmi.ATMICtx, svc *ServiceMap, qname string,
+	corrid string, peek bool) (atmi.TypedBuffer, atmi.ATMIError) {
+
+	var ctl atmi.TPQCTL
+
+	buf, errA := queueRspBuf(ac, svc)
+
+	if nil != errA {
+		ac.TpLogError("Failed to allocate reply buffer: %s", errA.Message())
+		return nil, errA
+	}
+
+	copy(ctl.Corrid[:], corrid)
+	ctl.Flags = atmi.TPQGETBYCORRID
+
+	if peek {
+		ctl.Flags |= atmi.TPQPEEK
+	}
+
+	if errA = ac.TpDequeue(svc.Qspace, qname, &ctl, buf, 0); nil != errA {
+
+		if atmi.TPEDIAGNOSTIC == errA.Code() && atmi.QMENOMSG == ctl.Diagnostic {
+			ac.TpLogDebug("No message in [%s/%s] for corrid [%s]",
+				svc.Qspace, qname, corrid)
+			return nil, nil
+		}
+
+		ac.TpLogError("Failed to dequeue from [%s/%s]: %s (diagnostic %d: %s)",
+			svc.Qspace, qname, errA.Message(), ctl.Diagnostic, ctl.Diagmsg)
+		return nil, errA
+	}
+
+	return buf, nil
+}
+
+//Remove the reply (or failed request) of enqueued request by correlation id.
+//Answers 204 if message is removed, 404 if there is no such message
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param corrid correlation id
+func queueRemove(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	corrid string) {
+
+	rctx := RequestContext{errSrc: ERRSRC_RESTIN}
+	qnames := []string{svc.Reply_queue}
+
+	if "" != svc.Failure_queue {
+		qnames = append(qnames, svc.Failure_queue)
+	}
+
+	for _, qname := range qnames {
+
+		buf, errA := queueDequeue(ac, svc, qname, corrid, false)
+
+		if nil != errA {
+			genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+			return
+		}
+
+		if nil != buf {
+			ac.TpLogInfo("Removed message from [%s/%s] for corrid [%s]",
+				svc.Qspace, qname, corrid)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	genHTTPErrRsp(ac, svc, w, http.StatusNotFound,
+		atmi.NewCustomATMIError(atmi.TPENOENT, "Reply not found"))
+}
+
+//Status route, read the reply of enqueued request by correlation id.
+//Reply is left in the queue, thus repeated reads (e.g. after lost response)
+//give the same result. DELETE method removes the reply.
+//If the reply is not yet available, 202 is returned
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param req HTTP request
+func queueStatus(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) {
+
+	rctx := RequestContext{errSrc: ERRSRC_RESTIN}
+	corrid := req.URL.Query().Get(QUEUE_CORRID_PARAM)
+
+	if "" == corrid || len(corrid) > atmi.TMCORRIDLEN {
+		genHTTPErrRsp(ac, svc, w, http.StatusBadRequest,
+			atmi.NewCustomATMIError(atmi.TPEINVAL, "Invalid correlation id"))
+		return
+	}
+
+	if http.MethodDelete == req.Method {
+		queueRemove(ac, svc, w, corrid)
+		return
+	}
+
+	buf, errA := queueDequeue(ac, svc, svc.Reply_queue, corrid, true)
+
+	if nil != errA {
+		genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+		return
+	}
+
+	if nil != buf {
+		rctx.errSrc = ERRSRC_SERVICE
+		genRsp(ac, buf, svc, w, nil, false, true, false, &rctx)
+		return
+	}
+
+	if "" != svc.Failure_queue {
+
+		buf, errA = queueDequeue(ac, svc, svc.Failure_queue, corrid, true)
+
+		if nil != errA {
+			genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+			return
+		}
+
+		if nil != buf {
+			rctx.errSrc = ERRSRC_SERVICE
+			genRsp(ac, buf, svc, w, atmi.NewCustomATMIError(atmi.TPESVCFAIL,
+				"Service failed"), false, true, false, &rctx)
+			return
+		}
+	}
+
+	genHTTPErrRsp(ac, svc, w, http.StatusAccepted,
+		atmi.NewCustomATMIError(atmi.TPEDIAGNOSTIC, "Reply not yet available"))
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
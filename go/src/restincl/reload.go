@@ -0,0 +1,257 @@
+/**
+ * @brief Configuration reload without restart
+ *
+ * @file reload.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	u "ubftab"
+)
+
+var M_reload_url string       //Reload end-point, empty - none
+var M_reloadmu sync.Mutex     //Reloads are serialized
+var M_routeCounts routeCounts //Resources created at startup
+
+//Replace the routes with the reloaded ones. Built-in end-points are kept.
+//@param ac ATMI Context
+//@param n reloaded routes
+//@param openapi regenerated OpenAPI document
+func (h *RegexpHandler) swap(ac *atmi.ATMICtx, n *RegexpHandler, openapi []byte) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.regexpRoutes = n.regexpRoutes
+	h.urlMap = n.urlMap
+	h.defaultHandler = n.defaultHandler
+	h.urlMethods = n.urlMethods
+
+	if nil != openapi {
+		M_openapi.Store(openapi)
+	}
+
+	ac.TpLogInfo("Routes replaced: %d urls, %d regexp",
+		len(h.urlMap), len(h.regexpRoutes))
+}
+
+//Re-read the configuration and replace the routes. On any error
+//the old configuration is kept.
+//@return error or nil
+func reloadConfig() error {
+
+	M_reloadmu.Lock()
+	defer M_reloadmu.Unlock()
+
+	//Dedicated context, as M_ac is used by the request handlers
+	ac, errA := atmi.NewATMICtx()
+
+	if nil != errA {
+		M_ac.TpLogError("Failed to allocate context: %s", errA.Message())
+		return errors.New(errA.Error())
+	}
+
+	defer func() {
+		ac.TpTerm()
+		ac.FreeATMICtx()
+	}()
+
+	ac.TpLogInfo("Reloading configuration...")
+
+	buf, err := getConfig(ac)
+
+	if nil != err {
+		return err
+	}
+
+	var defaults ServiceMap
+	initDefaults(&defaults)
+
+	workers := poolWorkers()
+	poolWaitTimeout := M_pool_wait_timeout
+
+	//Routes take the pool wait timeout, restore on failure
+	defer func() {
+		if nil != err {
+			M_pool_wait_timeout = poolWaitTimeout
+		}
+	}()
+
+	occs, _ := buf.BOccur(u.EX_CC_KEY)
+
+	for occ := 0; occ < occs; occ++ {
+
+		fldName, _ := buf.BGetString(u.EX_CC_KEY, occ)
+
+		switch fldName {
+		case "workers":
+			workers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "pool_wait_timeout":
+			M_pool_wait_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "defaults":
+			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
+
+			if err = parseDefaults(ac, jsonDefault, &defaults); nil != err {
+				return err
+			}
+			break
+		}
+	}
+
+	if workers <= 0 || workers > cap(M_freechan) {
+		ac.TpLogError("Invalid workers %d, max %d", workers, cap(M_freechan))
+		err = fmt.Errorf("Invalid workers %d, max %d", workers, cap(M_freechan))
+		return err
+	}
+
+	defaultErrorMap(&defaults)
+
+	var h RegexpHandler
+	var cnt routeCounts
+
+	h.initMaps()
+
+	if err = loadRoutes(ac, buf, &defaults, &h, &cnt, true); nil != err {
+		return err
+	}
+
+	if defaults.Parsecookies && !defaults.Parseheaders {
+		err = errors.New("Invalid config: parsecookies works only in parseheader mode")
+		return err
+	}
+
+	//Resources not created at startup
+	if cnt.ws > 0 && 0 == M_routeCounts.ws {
+		err = errors.New("WebSocket routes added, requires restart")
+	} else if cnt.idem > 0 && 0 == M_routeCounts.idem {
+		err = errors.New("Idempotency routes added, requires restart")
+	} else if cnt.tx > 0 && !M_txopen {
+		err = errors.New("Transaction routes added, requires restart")
+	}
+
+	if nil != err {
+		ac.TpLogError("Failed to reload: %s", err.Error())
+		return err
+	}
+
+	var openapi []byte
+
+	if "" != M_openapi_url {
+		if openapi, err = genOpenAPI(ac, &h); nil != err {
+			return err
+		}
+	}
+
+	//Routes carry their copy of the defaults
+	M_handler.swap(ac, &h, openapi)
+
+	if cnt.metrics > 0 {
+		M_metrics.enabled.Store(true)
+	}
+
+	//Cached responses may be produced by old routes
+	M_cache.mu.Lock()
+	M_cache.entries = make(map[string]*cacheEntry)
+	M_cache.lru.Init()
+	M_cache.mu.Unlock()
+
+	if current := poolWorkers(); workers != current {
+		ac.TpLogInfo("Resizing worker pool %d -> %d", current, workers)
+
+		if errP := resizePool(ac, workers); nil != errP {
+			//Routes are already active
+			ac.TpLogError("Failed to resize pool: %s", errP.Error())
+		}
+	}
+
+	ac.TpLogInfo("Configuration reloaded")
+
+	return nil
+}
+
+//Reload the configuration on SIGHUP
+//@param ac ATMI Context
+func handleReload(ac *atmi.ATMICtx) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	go func() {
+		for range signalChannel {
+			ac.TpLogWarn("Got SIGHUP - reloading configuration")
+
+			if err := reloadConfig(); nil != err {
+				ac.TpLogError("Configuration reload failed, "+
+					"old configuration kept: %s", err.Error())
+			}
+		}
+	}()
+}
+
+//Reload end-point
+//@param w response writer
+//@param req request
+func reloadRoute(w http.ResponseWriter, req *http.Request) {
+
+	if http.MethodPost != req.Method {
+		methodNotAllowed(w, []string{http.MethodPost})
+		return
+	}
+
+	status := http.StatusOK
+	rsp := map[string]string{"status": "ok"}
+
+	if err := reloadConfig(); nil != err {
+		M_ac.TpLogError("Configuration reload failed, "+
+			"old configuration kept: %s", err.Error())
+		status = http.StatusInternalServerError
+		rsp = map[string]string{"status": "failed", "error": err.Error()}
+	}
+
+	body, _ := json.Marshal(rsp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
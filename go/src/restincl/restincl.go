@@ -39,6 +39,7 @@ package main
 
 //Hmm we might need to put in channels a free ATMI contexts..
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,9 +47,13 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	u "ubftab"
 
 	atmi "github.com/endurox-dev/endurox-go"
@@ -79,12 +84,15 @@ const (
 	ERRORS_JSON2UBF  = 5
 	ERRORS_JSON2VIEW = 6
 	ERRORS_EXT       = 7 //External mode errors, direct UBF error codes, services
+	ERRORS_XML       = 8 //XML elements added to the response document
+	ERRORS_PROBLEM   = 9 //RFC 7807 problem details, status by error mapping
 )
 
 const (
 	ERRSRC_FINMAN  = "F" //Input mandatory filter failed
 	ERRSRC_SERVICE = "S" //Error source is target service
 	ERRSRC_RESTIN  = "R" //Error source is rest-in internal error
+	ERRSRC_TRAN    = "T" //Global transaction commit failed
 )
 
 //Conversion types resolved
@@ -94,8 +102,12 @@ const (
 	CONV_JSON      = 3
 	CONV_RAW       = 4
 	CONV_JSON2VIEW = 5
-	CONV_STATIC    = 6 //Serving static content
-	CONV_EXT       = 7 //External services, raw FML buffers
+	CONV_STATIC    = 6  //Serving static content
+	CONV_EXT       = 7  //External services, raw FML buffers
+	CONV_METRICS   = 8  //Serving metrics
+	CONV_WEBSOCKET = 9  //WebSocket messages to services
+	CONV_SSE       = 10 //Server-Sent Events from XATMI events
+	CONV_XML2UBF   = 11 //XML documents to UBF buffers
 )
 
 //Defaults
@@ -109,9 +121,15 @@ const (
 	ERRFMT_JSON_ONSUCC_DEFAULT = true /* generate success message in JSON */
 	ERRFMT_VIEW_ONSUCC_DEFAULT = true /* generate success message in VIEW */
 	ERRFMT_TEXT_DEFAULT        = "%d: %s"
+	ERRFMT_XML_MSG_DEFAULT     = "<error_message>%s</error_message>"
+	ERRFMT_XML_CODE_DEFAULT    = "<error_code>%d</error_code>"
+	ERRFMT_XML_ONSUCC_DEFAULT  = true /* generate success message in XML */
+	XML_ROOT_DEFAULT           = "UBF"
 	ASYNCCALL_DEFAULT          = false
 	STREAM_DEFAULT             = false
-	WORKERS                    = 10 /* Number of worker processes */
+	WORKERS                    = 10   /* Number of worker processes */
+	WORKERS_MAX                = 1024 /* Max workers, pool may grow by reload */
+	DRAIN_TIMEOUT_DEFAULT      = 30   /* Seconds to wait for in-flight requests on shutdown */
 )
 
 //We will have most of the settings as defaults
@@ -129,6 +147,15 @@ type ServiceMap struct {
 	//If set, then generate code/message for success too
 	Errfmt_json_onsucc bool `json:"errfmt_json_onsucc"`
 
+	//In case of xml errors, elements are added before closing root element
+	Errfmt_xml_msg    string `json:"errfmt_xml_msg"`
+	Errfmt_xml_code   string `json:"errfmt_xml_code"`
+	Errfmt_xml_onsucc bool   `json:"errfmt_xml_onsucc"`
+	Xml_root          string `json:"xml_root"` //Root element of xml2ubf response
+
+	//Type URI of problem details, in case of problem errors
+	Problem_type string `json:"problem_type"`
+
 	//In case of json2view errors, we install the return
 	//code direclty in the given fields
 	Errfmt_view_msg    string `json:"errfmt_view_msg"`
@@ -176,6 +203,7 @@ type ServiceMap struct {
 	Tempdir         string `json:"tempdir"`           // Temporary folder where to store uploaded files
 	JsonCookieField string `json:"json_cookie_field"` //Field for Cookie object in case of CONV_JSON
 	JsonHeaderField string `json:"json_header_field"` //Field for Headers in case of CONV_JSON
+	JsonCertField   string `json:"json_cert_field"`   //Field for client cert in case of CONV_JSON
 
 	//For ext mode:
 	Finman     string `json:"finman"` // Mandatory incoming services
@@ -196,23 +224,126 @@ type ServiceMap struct {
 	FileServer http.Handler //File server handler for static content
 
 	Stream bool `json:"stream"` // File streaming mode - e.g. file download handler
+
+	//HTTP methods bound to the route (from config key), empty - any method
+	Methods []string `json:"-"`
+
+	//Path parameters, URL template {name} or regexp named group (?P<name>...)
+	Pathfields map[string]string `json:"pathfields"` //Parameter name -> field/key
+	Pattern    *regexp.Regexp    `json:"-"`          //Compiled route pattern
+	Pathparams []PathParam       `json:"-"`          //Resolved path parameters
+
+	Listeners []string `json:"listeners"` //Listeners serving the route, empty - all
+
+	//Built-in authentication
+	Auth          string   `json:"auth"`            //basic, apikey, jwt, empty - none
+	Auth_int      int      `json:"-"`               //Resolved auth type
+	Auth_file     string   `json:"auth_file"`       //htpasswd (basic) or key file (apikey)
+	Auth_realm    string   `json:"auth_realm"`      //Realm for WWW-Authenticate
+	Auth_allow    []string `json:"auth_allow"`      //Allowed principals, empty - any
+	Apikey_header string   `json:"apikey_header"`   //Header carrying API key
+	Jwt_jwks      string   `json:"jwt_jwks"`        //Local JWKS file
+	Jwt_aud       string   `json:"jwt_aud"`         //Required audience, empty - no check
+	JsonAuthField string   `json:"json_auth_field"` //Field for principal in case of CONV_JSON
+	Authdb        *AuthDB  `json:"-"`               //Loaded credentials
+
+	//Limits
+	Rate_limit   float64       `json:"rate_limit"`   //Requests per second, 0 - none
+	Rate_burst   int           `json:"rate_burst"`   //Token bucket size
+	Rate_key     string        `json:"rate_key"`     //Bucket key: empty (route), ip, header:Name
+	Max_inflight int           `json:"max_inflight"` //Max concurrent calls, 0 - none
+	Limiter      *RouteLimiter `json:"-"`            //Limits state
+
+	//Max time in milliseconds to wait for free XATMI context, 0 - forever
+	Pool_wait_timeout int `json:"pool_wait_timeout"`
+
+	//VIEWs of json2view route, used for OpenAPI document only
+	Reqview string `json:"reqview"` //Request VIEW
+	Rspview string `json:"rspview"` //Response VIEW, empty - same as request
+
+	//CORS
+	Cors_origins     []string         `json:"cors_origins"`     //Allowed origins, * wildcards, empty - no CORS
+	Cors_methods     []string         `json:"cors_methods"`     //Methods for preflight, empty - route methods
+	Cors_headers     []string         `json:"cors_headers"`     //Allowed request headers, empty - as requested
+	Cors_expose      []string         `json:"cors_expose"`      //Response headers exposed to browser
+	Cors_credentials bool             `json:"cors_credentials"` //Allow credentials
+	Cors_max_age     int              `json:"cors_max_age"`     //Preflight cache seconds, 0 - not sent
+	Cors_any         bool             `json:"-"`                //Any origin allowed
+	Cors_rex         []*regexp.Regexp `json:"-"`                //Compiled origins
+
+	//Compression
+	Compress          bool     `json:"compress"`          //Compress responses, if accepted by client
+	Compress_min_size int      `json:"compress_min_size"` //Minimum response size to compress
+	Compress_types    []string `json:"compress_types"`    //Content types compressed, prefix match
+	Max_inflate_size  int64    `json:"max_inflate_size"`  //Decompressed request body cap, 0 - max msg size
+
+	//Body size limits
+	Max_body_size   int64 `json:"max_body_size"`   //Request body cap, 0 - max msg size (upload: none)
+	Max_file_size   int64 `json:"max_file_size"`   //Uploaded file cap, 0 - none
+	Max_upload_size int64 `json:"max_upload_size"` //Total uploaded files cap, 0 - none
+
+	//WebSocket
+	Ws_conv         string `json:"ws_conv"`           //Conversion of messages: json2ubf, json, text
+	Ws_conv_int     int    `json:"-"`                 //Resolved message conversion
+	JsonConnidField string `json:"json_connid_field"` //Field for connection id in case of json
+
+	//Server-Sent Events
+	Sse_event     string     `json:"sse_event"`     //Event expression (regexp) subscribed
+	Sse_filter    string     `json:"sse_filter"`    //Event filter, UBF boolean expression
+	Sse_name      string     `json:"sse_name"`      //SSE event name, empty - not sent
+	Sse_keepalive int        `json:"sse_keepalive"` //Keep-alive interval, seconds, 0 - off
+	Sse           *sseStream `json:"-"`             //Stream state
+
+	//Conversational streaming
+	Download_conv     bool `json:"download_conv"`     //Stream response chunks received by tprecv
+	Upload_conv       bool `json:"upload_conv"`       //Stream uploaded files to service by tpsend
+	Upload_chunk_size int  `json:"upload_chunk_size"` //Max bytes of file data per tpsend
+
+	//Idempotency-Key handling
+	Idempotency     bool `json:"idempotency"`     //Honour Idempotency-Key header
+	Idempotency_ttl int  `json:"idempotency_ttl"` //Stored response time to live, seconds
+
+	//Response caching
+	Cache_ttl     int      `json:"cache_ttl"`     //Cached response time to live, seconds, 0 - off
+	Cache_query   []string `json:"cache_query"`   //Query parameters in the key, empty - all
+	Cache_headers []string `json:"cache_headers"` //Request headers in the key
+
+	//Global transaction
+	Transaction         bool `json:"transaction"`         //Call filters and service in transaction
+	Transaction_timeout int  `json:"transaction_timeout"` //Transaction timeout, seconds
+
+	//Persistent queues
+	Qspace        string `json:"qspace"`        //Queue space
+	Queue         string `json:"queue"`         //Asynccall requests enqueued to
+	Reply_queue   string `json:"reply_queue"`   //Queue of the service replies
+	Failure_queue string `json:"failure_queue"` //Queue of the failed calls
+	Queue_status  bool   `json:"queue_status"`  //Route dequeues replies by correlation id
 }
 
 //Route information structure for Handles with Regexp path
 type route struct {
-	pattern *regexp.Regexp
-	handler http.Handler
+	pattern   *regexp.Regexp
+	methods   []string //Methods accepted, empty - any
+	listeners []string //Listeners serving the route, empty - all
+	handler   http.Handler
+	svc       ServiceMap //Route settings
 }
 
 //Custom handler to handle regexp and simple URLs
 //Simple URLs are stored in urlMap and http handler for them are stored in defaultHandler[]
+//Method bound simple URLs are keyed as "METHOD URL", see routeMethodKey()
 //If URL contains regexp, then regexpRoutes array is used which contains compiled pattern and handler
+//Routes are swapped by configuration reload, see swap()
 type RegexpHandler struct {
+	mu             sync.RWMutex //Protects the routes during reload
 	regexpRoutes   []*route
 	urlMap         map[string]ServiceMap
 	defaultHandler map[string]http.Handler
+	urlMethods     map[string][]string     //Methods bound to simple URLs (for Allow header)
+	builtin        map[string]http.Handler //Built-in end-points, see handleBuiltin()
 }
 
+//Legacy single listener settings, see M_listeners
 var M_port int = atmi.FAIL
 var M_ip string
 
@@ -221,10 +352,26 @@ var M_ip string
 
 var M_defaults ServiceMap
 
+//Built-in end-points (pool status, OpenAPI, reload) listeners and auth
+var M_admin ServiceMap
+var M_admin_route []byte //admin_route setting (JSON)
+
 /* TLS Settings: */
 var M_tls_enable int16 = FALSE
 var M_tls_cert_file string
 var M_tls_key_file string
+var M_tls_ca_roots string    //Semicolon separated CA roots for client certs
+var M_tls_client_auth int    //Client cert: 0 - none, 1 - require, 2 - if given
+var M_tls_min_version string //Minimum TLS version: TLS10, TLS11, TLS12
+
+/* HTTP server settings, may be overridden per listener: */
+var M_read_timeout int        //Request read timeout, seconds, 0 - none
+var M_read_header_timeout int //Request headers read timeout, seconds
+var M_write_timeout int       //Response write timeout, seconds, 0 - none
+var M_idle_timeout int        //Keep-alive idle timeout, seconds
+var M_max_header_bytes int    //Max request header size, 0 - Go default
+var M_http2 int               //HTTP/2 over TLS: 0 - off, 1 - on, UNSET - on with TLS
+var M_h2c int                 //Cleartext HTTP/2: 0 - off, 1 - on
 
 //Conversion types
 var M_convs = map[string]int{
@@ -236,11 +383,28 @@ var M_convs = map[string]int{
 	"json2view": CONV_JSON2VIEW,
 	"static":    CONV_STATIC,
 	"ext":       CONV_EXT,
+	"metrics":   CONV_METRICS,
+	"websocket": CONV_WEBSOCKET,
+	"sse":       CONV_SSE,
+	"xml2ubf":   CONV_XML2UBF,
+}
+
+//Check that route calls the service with converted request, i.e. it is not
+//static, metrics, websocket or sse route
+//@param conv conversion type
+//@return true if request is converted for the service
+func isCallConv(conv int) bool {
+	return (conv <= CONV_EXT && CONV_STATIC != conv) || CONV_XML2UBF == conv
 }
 
 var M_workers int
 var M_ac *atmi.ATMICtx //Mainly shared for logging....
 
+var M_drain_timeout int = DRAIN_TIMEOUT_DEFAULT //Shutdown drain time, seconds
+var M_pool_wait_timeout int                     //Free context wait time, ms, 0 - forever
+var M_pool_status_url string                    //Pool status end-point, empty - none
+var M_drained = make(chan bool)                 //Closed when shutdown drain is done
+
 /*
  * Handler object, provides:
  * - ServeHTTP() for request handling (real time):
@@ -253,36 +417,144 @@ var M_handler RegexpHandler //Global HTTP call handler which contains regexp and
 
 var M_cctag string //CCTAG from env
 
+//Route key with method prefix, e.g. "GET /orders" or "GET,HEAD /orders"
+var M_routeKeyRex = regexp.MustCompile("^([A-Za-z]+(\\s*,\\s*[A-Za-z]+)*)\\s+(/.*)$")
+
+//Build the urlMap key for method bound URL
+func routeMethodKey(method string, url string) string {
+	return method + " " + url
+}
+
+//Check is the config key a route
+//@param key config key
+//@return true if key is route (URL with optional method prefix)
+func isRouteKey(key string) bool {
+	return strings.HasPrefix(key, "/") || M_routeKeyRex.MatchString(key)
+}
+
+//Split route config key into HTTP methods and URL
+//@param key config key in format [METHOD[,METHOD...] ]/url
+//@return methods (nil if any method accepted), url
+func parseRouteKey(key string) ([]string, string) {
+
+	if strings.HasPrefix(key, "/") {
+		return nil, key
+	}
+
+	parsed := M_routeKeyRex.FindStringSubmatch(key)
+
+	if nil == parsed {
+		return nil, key
+	}
+
+	var methods []string
+	for _, m := range strings.Split(parsed[1], ",") {
+		methods = append(methods, strings.ToUpper(strings.TrimSpace(m)))
+	}
+
+	return methods, parsed[3]
+}
+
+//Check that route accepts given method
+//@param methods methods bound to route
+//@param method request method
+//@return true if accepted
+func acceptsMethod(methods []string, method string) bool {
+
+	if len(methods) == 0 {
+		return true
+	}
+
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Reply with 405, listing the methods available for the URL
+//@param w response writer
+//@param allowed list of methods (may contain duplicates)
+func methodNotAllowed(w http.ResponseWriter, allowed []string) {
+
+	seen := make(map[string]bool)
+	var uniq []string
+
+	for _, m := range allowed {
+		if !seen[m] {
+			seen[m] = true
+			uniq = append(uniq, m)
+		}
+	}
+
+	sort.Strings(uniq)
+	w.Header().Set("Allow", strings.Join(uniq, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+		http.StatusMethodNotAllowed)
+}
+
 //HandleFunc Can be used to add regexp or exact match URLs which uses dispathRequest()
 // to handle request
 //if regexp patters is nil, then add exact match URL, otherwise add compiled regexp
 //and handler to global handler struct
+//If svc.Methods is set, then route is registered for given HTTP methods only
+//If svc.Listeners is set, then route is served on given listeners only
 func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
-	if svc.Format == "regexp" || svc.Format == "r" {
-		h.regexpRoutes = append(h.regexpRoutes, &route{pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if nil != pattern {
+		h.regexpRoutes = append(h.regexpRoutes, &route{pattern: pattern, methods: svc.Methods, listeners: svc.Listeners, svc: svc, handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			corsHeaders(w, r, &svc)
 
 			if CONV_STATIC == svc.Conv_int {
 				result := strings.Split(r.URL.Path, "/")
 				//M_ac.TpLogInfo("Got Static request... [%s] base: [%s] rex", r.URL.Path, result[1])
 				http.StripPrefix("/"+result[1], svc.FileServer).ServeHTTP(w, r)
 
+			} else if CONV_METRICS == svc.Conv_int {
+				metricsRoute(w, r, svc)
+			} else if CONV_WEBSOCKET == svc.Conv_int {
+				websocketRoute(w, r, svc)
+			} else if CONV_SSE == svc.Conv_int {
+				sseRoute(w, r, svc)
 			} else {
 				//M_ac.TpLogInfo("Got XATMI request...")
 				dispatchRequest(w, r, svc)
 			}
 		})})
 	} else {
-		h.urlMap[svc.Url] = svc
-		h.defaultHandler[svc.Url] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			corsHeaders(w, r, &svc)
+
 			if CONV_STATIC == svc.Conv_int {
 				result := strings.Split(r.URL.Path, "/")
 				//M_ac.TpLogInfo("Got Static request... [%s] base: [%s] stat", r.URL.Path, result[1])
 				http.StripPrefix("/"+result[1], svc.FileServer).ServeHTTP(w, r)
+			} else if CONV_METRICS == svc.Conv_int {
+				metricsRoute(w, r, svc)
+			} else if CONV_WEBSOCKET == svc.Conv_int {
+				websocketRoute(w, r, svc)
+			} else if CONV_SSE == svc.Conv_int {
+				sseRoute(w, r, svc)
 			} else {
 				//M_ac.TpLogInfo("Got XATMI request...")
 				dispatchRequest(w, r, svc)
 			}
 		})
+
+		if len(svc.Methods) == 0 {
+			h.urlMap[svc.Url] = svc
+			h.defaultHandler[svc.Url] = handler
+		} else {
+			for _, method := range svc.Methods {
+				key := routeMethodKey(method, svc.Url)
+				h.urlMap[key] = svc
+				h.defaultHandler[key] = handler
+				h.urlMethods[svc.Url] = append(h.urlMethods[svc.Url], method)
+			}
+		}
 	}
 }
 
@@ -290,26 +562,30 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
 //This function is called when incomming request is received
 //It checks if urlMap contains exact match URL and if it does, calls corresponding
 // handler which calls dispatchRequest()
+//Method bound URL ("METHOD URL" key) is checked first, then URL with any method.
 //If URL is not in urlMap (exact match) ServeHTTP checks all compiled regexps
 //and calls dispatchRequest() on match.
+//If URL matched, but not for the request method, 405 with Allow header is sent.
+//Routes not bound to the listener which accepted the request are skipped.
 func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	//M_ac.TpLogInfo("ServeHTTP: [%s]", r.URL.Path)
 
-	svc := h.urlMap[r.URL.Path]
-	if svc.Svc != "" || svc.Echo {
-		//M_ac.TpLogInfo("Default ServeHTTP: [%s]", r.URL.Path)
+	//Handler is resolved under the lock, as routes may be reloaded
+	h.mu.RLock()
+	handler, allowed := h.resolve(r)
+	h.mu.RUnlock()
 
-		h.defaultHandler[r.URL.Path].ServeHTTP(w, r)
+	if nil != handler {
+		handler.ServeHTTP(w, r)
 		return
 	}
 
-	for _, route := range h.regexpRoutes {
-		//M_ac.TpLogInfo("REX ServeHTTP: [%s]", r.URL.Path)
-		if route.pattern.MatchString(r.URL.Path) {
-			route.handler.ServeHTTP(w, r)
-			return
-		}
+	if len(allowed) > 0 {
+		M_ac.TpLogWarn("Method [%s] not allowed for [%s] (allowed: %v)",
+			r.Method, r.URL.Path, allowed)
+		methodNotAllowed(w, allowed)
+		return
 	}
 	//M_ac.TpLogInfo("404 ServeHTTP: [%s]", r.URL.Path)
 
@@ -317,6 +593,63 @@ func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+//Find the handler of the request
+//@param r HTTP request
+//@return handler (nil if not found), methods allowed if URL matched, but
+//not for the request method
+func (h *RegexpHandler) resolve(r *http.Request) (http.Handler, []string) {
+
+	listener := requestListener(r)
+
+	if handler, ok := h.builtin[r.URL.Path]; ok &&
+		boundToListener(M_admin.Listeners, listener) {
+		return handler, nil
+	}
+
+	//Answer CORS preflight without calling XATMI
+	if isPreflight(r) {
+		if svc := h.preflightRoute(r, listener); nil != svc {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				corsPreflight(w, r, svc)
+			}), nil
+		}
+	}
+
+	for _, key := range []string{routeMethodKey(r.Method, r.URL.Path), r.URL.Path} {
+		svc := h.urlMap[key]
+		if (svc.Svc != "" || svc.Echo) && boundToListener(svc.Listeners, listener) {
+			//M_ac.TpLogInfo("Default ServeHTTP: [%s]", key)
+
+			return h.defaultHandler[key], nil
+		}
+	}
+
+	//Methods available for the URL, in case if request method does not match
+	var allowed []string
+
+	for _, method := range h.urlMethods[r.URL.Path] {
+		svc := h.urlMap[routeMethodKey(method, r.URL.Path)]
+		if boundToListener(svc.Listeners, listener) {
+			allowed = append(allowed, method)
+		}
+	}
+
+	for _, route := range h.regexpRoutes {
+		//M_ac.TpLogInfo("REX ServeHTTP: [%s]", r.URL.Path)
+		if boundToListener(route.listeners, listener) &&
+			route.pattern.MatchString(r.URL.Path) {
+
+			if acceptsMethod(route.methods, r.Method) {
+				return route.handler, nil
+			}
+
+			allowed = append(allowed, route.methods...)
+		}
+	}
+
+	return nil, allowed
+}
+
 //Remap the error from string to int constant
 //for better performance...
 func remapErrors(svc *ServiceMap) error {
@@ -340,6 +673,12 @@ func remapErrors(svc *ServiceMap) error {
 	case "ext":
 		svc.Errors_int = ERRORS_EXT
 		break
+	case "xml":
+		svc.Errors_int = ERRORS_XML
+		break
+	case "problem":
+		svc.Errors_int = ERRORS_PROBLEM
+		break
 	default:
 		return fmt.Errorf("Unsupported error type [%s]", svc.Errors)
 	}
@@ -347,64 +686,110 @@ func remapErrors(svc *ServiceMap) error {
 	return nil
 }
 
-//Run the listener
+//Run the listeners
 //Listener uses custom handler to support Regexp and simple URLs separatly
+//Each listener is served by its own HTTP server, function returns when all
+//listeners are closed or some listener failed.
 func apprun(ac *atmi.ATMICtx) error {
 
-	var err error
-	//TODO: Some works needed for TLS...
-	listenOn := fmt.Sprintf("%s:%d", M_ip, M_port)
-	ac.TpLog(atmi.LOG_INFO, "About to listen on: (ip: %s, port: %d) %s",
-		M_ip, M_port, listenOn)
+	errs := make(chan error, len(M_listeners))
 
-	/*
-		l, err := net.Listen("tcp", listenOn)
+	for _, l := range M_listeners {
+		go func(l *Listener) {
+			errs <- runListener(ac, l)
+		}(l)
+	}
 
-		if err != nil {
-			ac.TpLog(atmi.LOG_ERROR, "Listen failed on %s: %v", listenOn, err)
+	for range M_listeners {
+		if err := <-errs; nil != err {
 			return err
 		}
+	}
 
-		defer l.Close()
+	return nil
+}
 
-		l = netutil.LimitListener(l, M_workers)
-	*/
+//Init function, read config (with CCTAG)
+func dispatchRequest(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
 
-	if TRUE == M_tls_enable {
+	//Collect metrics, if enabled
+	if M_metrics.enabled.Load() {
+		mw, mreq := metricsBegin(w, req, &svc)
+		defer metricsEnd(mw, &svc)
+		w, req = mw, mreq
+	}
 
-		/* To prepare cert (self-signed) do following steps:
-		 * - TODO
-		 */
-		err = http.ListenAndServeTLS(listenOn, M_tls_cert_file, M_tls_key_file, &M_handler)
+	//Check route limits and authenticate before any XATMI resources are used
+	if !limitFilter(w, req, &svc) {
+		return
+	}
 
-		/*	err = http.ServeTLS(l, &M_handler, M_tls_cert_file, M_tls_key_file) */
+	defer svc.Limiter.release()
 
-		ac.TpLog(atmi.LOG_ERROR, "ListenAndServeTLS() failed: %s", err)
-	} else {
-		/*err = http.Serve(l, &M_handler)*/
-		err = http.ListenAndServe(listenOn, &M_handler)
-		ac.TpLog(atmi.LOG_ERROR, "ListenAndServe() failed: %s", err)
+	req, ok := authFilter(w, req, &svc)
+
+	if !ok {
+		return
 	}
 
-	return err
-}
+	if !bodyLimitFilter(w, req, &svc) {
+		return
+	}
 
-//Init function, read config (with CCTAG)
-func dispatchRequest(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
+	if !inflateFilter(w, req, &svc) {
+		return
+	}
+
+	if svc.Compress {
+		if cw := compressBegin(w, req, &svc); nil != cw {
+			defer cw.Close()
+			w = cw
+		}
+	}
+
+	//Repeated requests get the stored response (uncompressed is recorded)
+	var iw *idemWriter
+
+	if svc.Idempotency {
+		var ok bool
+
+		if iw, ok = idemBegin(w, req, &svc); !ok {
+			return
+		} else if nil != iw {
+			defer idemEnd(iw)
+			w = iw
+		}
+	}
 
 	M_ac.TpLog(atmi.LOG_DEBUG, "URL [%s] getting free goroutine caller: %s",
 		req.URL, req.RemoteAddr)
 
-	nr := <-M_freechan
+	nr := getFreeCtx(svc.Pool_wait_timeout)
+
+	if atmi.FAIL == nr {
+		M_ac.TpLogError("URL [%s] no free XATMI context in %d ms (waiting: %d)",
+			req.URL, svc.Pool_wait_timeout, atomic.LoadInt64(&M_poolwaiting))
+
+		w.Header().Set("Retry-After", "1")
+		genHTTPErrRsp(M_ac, &svc, w, http.StatusServiceUnavailable,
+			atmi.NewCustomATMIError(atmi.TPELIMIT, "No free XATMI context"))
+		return
+	}
 
 	M_ac.TpLogInfo("Got free goroutine, nr %d", nr)
 
-	handleMessage(M_ctxs[nr], &svc, w, req)
+	//Context is released also if response is aborted
+	defer func() {
+		M_ac.TpLogInfo("Request processing done %d... releasing the context", nr)
 
-	M_ac.TpLogInfo("Request processing done %d... releasing the context", nr)
+		M_freechan <- nr
+	}()
 
-	M_freechan <- nr
+	handleMessage(poolCtx(nr), &svc, w, req)
 
+	if nil != iw {
+		iw.processed = true
+	}
 }
 
 //Map the ATMI Errors to Http errors
@@ -452,12 +837,13 @@ func parseHTTPErrorMap(ac *atmi.ATMICtx, svc *ServiceMap) error {
 
 //Print the summary of the service after init
 func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
-	ac.TpLogWarn("Service: %s, Url: %s, Async mode: %t, Log request svc: [%s], "+
+	ac.TpLogWarn("Service: %s, Url: %s, Methods: %v, Async mode: %t, Log request svc: [%s], "+
 		"Errors:%d (%s), Async echo %t, "+
 		"Streaming mode: %t, "+
 		"Filters: inman:%s/inopt:%s/inerr:%s/outman:%s/outopt:%s/outerr:%s",
 		svc.Svc,
 		svc.Url,
+		svc.Methods,
 		svc.Asynccall,
 		svc.Reqlogsvc,
 		svc.Errors_int,
@@ -466,7 +852,8 @@ func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
 		svc.Stream,
 		svc.Finman, svc.Finopt, svc.Finerr, svc.Foutman, svc.Foutopt, svc.Fouterr)
 
-	ac.TpLogWarn("fileupload:%t tempdir:[%s]", svc.Fileupload, svc.Tempdir)
+	ac.TpLogWarn("fileupload:%t tempdir:[%s] listeners:%v", svc.Fileupload,
+		svc.Tempdir, svc.Listeners)
 }
 
 //Validate external service definitions
@@ -566,148 +953,256 @@ func validateExtService(ac *atmi.ATMICtx, svc *ServiceMap) error {
 	return nil
 }
 
-//Un-init function
-func appinit(ac *atmi.ATMICtx) error {
-	//runtime.LockOSThread()
-	M_handler.urlMap = make(map[string]ServiceMap)
-	M_handler.defaultHandler = make(map[string]http.Handler)
-
-	//Setup default configuration
-	M_defaults.Errors_int = ERRORS_DEFAULT
-	M_defaults.Notime = NOTIMEOUT_DEFAULT
-	M_defaults.Conv = CONV_DEFAULT
-	M_defaults.Conv_int = CONV_INT_DEFAULT
-	M_defaults.Errfmt_json_msg = ERRFMT_JSON_MSG_DEFAULT
-	M_defaults.Errfmt_json_code = ERRFMT_JSON_CODE_DEFAULT
-	M_defaults.Errfmt_json_onsucc = ERRFMT_JSON_ONSUCC_DEFAULT
-	M_defaults.Errfmt_text = ERRFMT_TEXT_DEFAULT
-	M_defaults.Asynccall = ASYNCCALL_DEFAULT
-	M_defaults.Errfmt_view_onsucc = ERRFMT_VIEW_ONSUCC_DEFAULT
-	M_defaults.Stream = STREAM_DEFAULT
+//Setup default configuration of the routes
+//@param defaults service map to initialise
+func initDefaults(defaults *ServiceMap) {
+	defaults.Errors_int = ERRORS_DEFAULT
+	defaults.Notime = NOTIMEOUT_DEFAULT
+	defaults.Conv = CONV_DEFAULT
+	defaults.Conv_int = CONV_INT_DEFAULT
+	defaults.Errfmt_json_msg = ERRFMT_JSON_MSG_DEFAULT
+	defaults.Errfmt_json_code = ERRFMT_JSON_CODE_DEFAULT
+	defaults.Errfmt_json_onsucc = ERRFMT_JSON_ONSUCC_DEFAULT
+	defaults.Errfmt_text = ERRFMT_TEXT_DEFAULT
+	defaults.Errfmt_xml_msg = ERRFMT_XML_MSG_DEFAULT
+	defaults.Errfmt_xml_code = ERRFMT_XML_CODE_DEFAULT
+	defaults.Errfmt_xml_onsucc = ERRFMT_XML_ONSUCC_DEFAULT
+	defaults.Xml_root = XML_ROOT_DEFAULT
+	defaults.Problem_type = PROBLEM_TYPE_DEFAULT
+	defaults.Asynccall = ASYNCCALL_DEFAULT
+	defaults.Errfmt_view_onsucc = ERRFMT_VIEW_ONSUCC_DEFAULT
+	defaults.Stream = STREAM_DEFAULT
+	defaults.Pool_wait_timeout = UNSET
+	defaults.Sse_keepalive = UNSET
+	defaults.Idempotency_ttl = UNSET
+	defaults.Transaction_timeout = UNSET
+	defaults.Compress_min_size = COMPRESS_MIN_SIZE_DEFAULT
+}
 
-	M_workers = WORKERS
+//Register built-in end-point, served before routes on admin_route listeners,
+//authenticated by admin_route settings
+//@param url URL path
+//@param handler end-point handler
+func (h *RegexpHandler) handleBuiltin(url string, handler http.HandlerFunc) {
 
-	if err := ac.TpInit(); err != nil {
-		return errors.New(err.Error())
+	h.builtin[url] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		r, ok := authFilter(w, r, &M_admin)
+
+		if !ok {
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+//Setup listeners and authentication of built-in end-points
+//@param ac ATMI Context
+//@return error or nil
+func initAdminRoute(ac *atmi.ATMICtx) error {
+
+	initDefaults(&M_admin)
+	defaultErrorMap(&M_admin)
+	M_admin.Url = "admin_route"
+
+	if len(M_admin_route) > 0 {
+		if jerr := json.Unmarshal(M_admin_route, &M_admin); nil != jerr {
+			ac.TpLogError("Failed to parse admin_route: %s", jerr.Error())
+			return jerr
+		}
+
+		//Error format is optional for the built-ins
+		if "" == M_admin.Errors {
+			M_admin.Errors = "json"
+		}
+
+		if err := remapErrors(&M_admin); nil != err {
+			ac.TpLogError("admin_route: %s", err.Error())
+			return err
+		}
 	}
 
-	//Get the configuration
+	if err := validateRouteListeners(ac, &M_admin); nil != err {
+		return err
+	}
+
+	if err := initAuth(ac, &M_admin); nil != err {
+		return err
+	}
+
+	//Reload must not be open to any client
+	if "" != M_reload_url && 0 == len(M_admin.Listeners) &&
+		AUTH_NONE == M_admin.Auth_int {
+		ac.TpLogError("reload_url requires admin_route with listeners or auth")
+		return errors.New("reload_url requires admin_route with listeners or auth")
+	}
+
+	return nil
+}
+
+//Create empty route maps of the handler
+func (h *RegexpHandler) initMaps() {
+	h.urlMap = make(map[string]ServiceMap)
+	h.defaultHandler = make(map[string]http.Handler)
+	h.urlMethods = make(map[string][]string)
+	h.builtin = make(map[string]http.Handler)
+}
+
+//Read the configuration from common-config server (with CCTAG)
+//@param ac ATMI Context
+//@return configuration buffer or error
+func getConfig(ac *atmi.ATMICtx) (*atmi.TypedUBF, error) {
 
 	buf, err := ac.NewUBF(16 * 1024)
 	if nil != err {
 		ac.TpLog(atmi.LOG_ERROR, "Failed to allocate buffer: [%s]", err.Error())
-		return errors.New(err.Error())
+		return nil, errors.New(err.Error())
 	}
 
 	buf.BChg(u.EX_CC_CMD, 0, "g")
-	M_cctag = os.Getenv("NDRX_CCTAG")
 	buf.BChg(u.EX_CC_LOOKUPSECTION, 0, fmt.Sprintf("%s/%s", progsection, M_cctag))
 
 	if _, err := ac.TpCall("@CCONF", buf, 0); nil != err {
 		ac.TpLog(atmi.LOG_ERROR, "ATMI Error %d:[%s]\n", err.Code(), err.Message())
-		return errors.New(err.Error())
+		return nil, errors.New(err.Error())
 	}
 
 	buf.TpLogPrintUBF(atmi.LOG_DEBUG, "Got configuration.")
 
-	//Set the parameters (ip/port/services)
+	return buf, nil
+}
 
-	occs, _ := buf.BOccur(u.EX_CC_KEY)
-	// Load in the config...
-	for occ := 0; occ < occs; occ++ {
-		ac.TpLog(atmi.LOG_DEBUG, "occ %d", occ)
-		fldName, err := buf.BGetString(u.EX_CC_KEY, occ)
+//Override the defaults from config
+//@param ac ATMI Context
+//@param jsonDefault defaults block (JSON)
+//@param defaults service map to update
+//@return error or nil
+func parseDefaults(ac *atmi.ATMICtx, jsonDefault []byte, defaults *ServiceMap) error {
+
+	jerr := json.Unmarshal(jsonDefault, defaults)
+	if jerr != nil {
+		ac.TpLog(atmi.LOG_ERROR,
+			fmt.Sprintf("Failed to parse defaults: %s", jerr))
+		return jerr
+	}
 
-		if nil != err {
-			ac.TpLog(atmi.LOG_ERROR, "Failed to get field "+
-				"%d occ %d", u.EX_CC_KEY, occ)
-			return errors.New(err.Error())
+	if defaults.Errors_fmt_http_map_str != "" {
+		if jerr := parseHTTPErrorMap(ac, defaults); jerr != nil {
+			return jerr
 		}
+	}
 
-		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
+	remapErrors(defaults)
 
-		switch fldName {
-		case "debug":
-			//Set debug configuration string
-			debug, _ := buf.BGetString(u.EX_CC_VALUE, occ)
-			ac.TpLogDebug("Got [%s] = [%s] ", fldName, debug)
-			if err := ac.TpLogConfig((atmi.LOG_FACILITY_NDRX | atmi.LOG_FACILITY_UBF | atmi.LOG_FACILITY_TP),
-				-1, debug, "ROUT", ""); nil != err {
-				ac.TpLogError("Invalid debug config [%s] %d:[%s]",
-					debug, err.Code(), err.Message())
-				return fmt.Errorf("Invalid debug config [%s] %d:[%s]",
-					debug, err.Code(), err.Message())
-			}
+	defaults.Conv_int = M_convs[defaults.Conv]
+	if defaults.Conv_int == 0 {
+		return fmt.Errorf("Invalid conv: %s", defaults.Conv)
+	}
 
-			break
-		case "workers":
-			M_workers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
-			break
-		case "gencore":
-			gencore, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+	//Validate view settings (if any)
+	if errS := VIEWSvcValidateSettings(ac, defaults); errS != nil {
+		return errS
+	}
 
-			if TRUE == gencore {
-				//Process signals by default handlers
-				ac.TpLogInfo("gencore=1 - SIGSEG signal will be " +
-					"processed by default OS handler")
-				// Have some core dumps...
-				C.signal(11, nil)
-			}
-			break
-		case "port":
-			M_port, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
-			break
-		case "ip":
-			M_ip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
-			break
-		case "tls_enable":
-			M_tls_enable, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
-			break
-		case "tls_cert_file":
-			M_tls_cert_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
-			break
-		case "tls_key_file":
-			M_tls_key_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
-			break
-		case "defaults":
-			//Override the defaults
-			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
+	//Validate ext
+	if errS := validateExtService(ac, defaults); errS != nil {
+		return errS
+	}
 
-			jerr := json.Unmarshal(jsonDefault, &M_defaults)
-			if jerr != nil {
-				ac.TpLog(atmi.LOG_ERROR,
-					fmt.Sprintf("Failed to parse defaults: %s", jerr))
-				return jerr
-			}
+	printSvcSummary(ac, defaults)
 
-			if M_defaults.Errors_fmt_http_map_str != "" {
-				if jerr := parseHTTPErrorMap(ac, &M_defaults); err != nil {
-					return jerr
-				}
-			}
+	return nil
+}
 
-			remapErrors(&M_defaults)
+//Add the default erorr mappings, if not set by config
+//@param defaults route defaults
+func defaultErrorMap(defaults *ServiceMap) {
 
-			M_defaults.Conv_int = M_convs[M_defaults.Conv]
-			if M_defaults.Conv_int == 0 {
-				return fmt.Errorf("Invalid conv: %s", M_defaults.Conv)
-			}
+	if defaults.Errors_fmt_http_map_str == "" {
 
-			//Validate view settings (if any)
-			if errS := VIEWSvcValidateSettings(ac, &M_defaults); errS != nil {
-				return errS
-			}
+		//https://golang.org/src/net/http/status.go
+		defaults.Errors_fmt_http_map = make(map[string]int)
+		//Accepted
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPMINVAL)] =
+			http.StatusOK
+		//Errors:
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEABORT)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBADDESC)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBLOCK)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEINVAL)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPELIMIT)] =
+			http.StatusRequestEntityTooLarge
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPENOENT)] =
+			http.StatusNotFound
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOS)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPERM)] =
+			http.StatusUnauthorized
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPROTO)] =
+			http.StatusBadRequest
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCERR)] =
+			http.StatusBadGateway
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCFAIL)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESYSTEM)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETIME)] =
+			http.StatusGatewayTimeout
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETRAN)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERMERR)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEITYPE)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOTYPE)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERELEASE)] =
+			http.StatusInternalServerError
+		//Transaction outcome unknown
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHAZARD)] =
+			http.StatusBadGateway
+		//Transaction partially committed
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHEURISTIC)] =
+			http.StatusConflict
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEEVENT)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMATCH)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEDIAGNOSTIC)] =
+			http.StatusInternalServerError
+		defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMIB)] =
+			http.StatusInternalServerError
+		//Anything other goes to server error.
+		defaults.Errors_fmt_http_map["*"] = http.StatusInternalServerError
 
-			//Validate ext
-			if errS := validateExtService(ac, &M_defaults); errS != nil {
-				return errS
-			}
+	}
+}
 
-			printSvcSummary(ac, &M_defaults)
+//Counters of the route features, which need process level resources
+type routeCounts struct {
+	ws      int //WebSocket routes
+	idem    int //Routes with Idempotency-Key handling
+	tx      int //Routes called in global transaction
+	metrics int //Metrics routes
+}
 
-			break
-		}
-	}
+//Load the routes from config (second pass), into the handler
+//@param ac ATMI Context
+//@param buf configuration buffer
+//@param defaults route defaults
+//@param h handler to which routes are added
+//@param cnt route feature counters
+//@param reload config is reloaded, process level resources are not created
+//@return error or nil
+func loadRoutes(ac *atmi.ATMICtx, buf *atmi.TypedUBF, defaults *ServiceMap,
+	h *RegexpHandler, cnt *routeCounts, reload bool) error {
+
+	occs, _ := buf.BOccur(u.EX_CC_KEY)
 
 	//Bug #461 Load the services in second pass..
 	ac.TpLogInfo("Second pass config process - service load")
@@ -724,12 +1219,18 @@ func appinit(ac *atmi.ATMICtx) error {
 		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
 
 		//Load routes...
-		if strings.HasPrefix(fldName, "/") {
+		if isRouteKey(fldName) {
 			cfgVal, _ := buf.BGetString(u.EX_CC_VALUE, occ)
 
 			ac.TpLogInfo("Got route config [%s]", cfgVal)
 
-			tmp := M_defaults
+			tmp := *defaults
+
+			//Do not let the route to update the defaults map
+			tmp.Pathfields = make(map[string]string)
+			for k, v := range defaults.Pathfields {
+				tmp.Pathfields[k] = v
+			}
 
 			//Override the stuff from current config
 
@@ -745,9 +1246,10 @@ func appinit(ac *atmi.ATMICtx) error {
 				return err
 			}
 
-			ac.TpLogDebug("Got route: URL [%s] -> Service [%s]",
-				fldName, tmp.Svc)
-			tmp.Url = fldName
+			tmp.Methods, tmp.Url = parseRouteKey(fldName)
+
+			ac.TpLogDebug("Got route: URL [%s] methods %v -> Service [%s]",
+				tmp.Url, tmp.Methods, tmp.Svc)
 
 			//Parse http errors for
 			if tmp.Errors_fmt_http_map_str != "" {
@@ -787,6 +1289,23 @@ func appinit(ac *atmi.ATMICtx) error {
 					ac.TpLogInfo("Static file server [%s] OK", tmp.StaticDir)
 				}
 
+			} else if CONV_METRICS == tmp.Conv_int {
+				ac.TpLogInfo("Metrics served at [%s]", tmp.Url)
+				cnt.metrics++
+			} else if CONV_WEBSOCKET == tmp.Conv_int {
+				if err = initWebSocket(ac, &tmp); err != nil {
+					return err
+				}
+				cnt.ws++
+			} else if CONV_SSE == tmp.Conv_int && reload {
+				//Streams are subscribed at startup
+				if err = sseReuse(ac, &tmp); err != nil {
+					return err
+				}
+			} else if CONV_SSE == tmp.Conv_int {
+				if err = initSse(ac, &tmp); err != nil {
+					return err
+				}
 			}
 
 			//Default temporary folder
@@ -794,6 +1313,11 @@ func appinit(ac *atmi.ATMICtx) error {
 				tmp.Tempdir = os.TempDir()
 			}
 
+			//Default context wait time
+			if UNSET == tmp.Pool_wait_timeout {
+				tmp.Pool_wait_timeout = M_pool_wait_timeout
+			}
+
 			//Validate view settings (if any)
 			if err = VIEWSvcValidateSettings(ac, &tmp); err != nil {
 				return err
@@ -804,121 +1328,370 @@ func appinit(ac *atmi.ATMICtx) error {
 				return err
 			}
 
+			//Validate listener binding
+			if err = validateRouteListeners(ac, &tmp); err != nil {
+				return err
+			}
+
+			//Load authentication settings
+			if err = initAuth(ac, &tmp); err != nil {
+				return err
+			}
+
+			//Prepare rate limit and concurrency cap
+			if err = initLimits(ac, &tmp); err != nil {
+				return err
+			}
+
+			//Compile CORS origins
+			if err = initCors(ac, &tmp); err != nil {
+				return err
+			}
+
+			if err = initCompress(ac, &tmp); err != nil {
+				return err
+			}
+
+			if err = initConvStream(ac, &tmp); err != nil {
+				return err
+			}
+
+			if err = initIdempotency(ac, &tmp); err != nil {
+				return err
+			}
+
+			if tmp.Idempotency {
+				cnt.idem++
+			}
+
+			if err = initCache(ac, &tmp); err != nil {
+				return err
+			}
+
+			if err = initTransaction(ac, &tmp); err != nil {
+				return err
+			}
+
+			if tmp.Transaction {
+				cnt.tx++
+			}
+
+			if err = initQueue(ac, &tmp); err != nil {
+				return err
+			}
+
 			printSvcSummary(ac, &tmp)
 
-			ac.TpLogInfo("Checking if service uses regexp")
-			//Add to HTTP listener
+			ac.TpLogInfo("Checking if service uses regexp or URL template")
+			rex := ""
 			if tmp.Format == "regexp" || tmp.Format == "r" {
-				if r, err := regexp.Compile(fldName); err == nil {
-					ac.TpLogInfo("Regexp compiled")
-					M_handler.HandleFunc(r, tmp)
+				rex = tmp.Url
+			} else if tmp.Format == "template" || tmp.Format == "t" {
+				rex = templateToRegexp(tmp.Url)
+			} else if isTemplateURL(tmp.Url) {
+				ac.TpLogWarn("Route [%s] matched as exact path, set format "+
+					"to template for URL template", tmp.Url)
+			}
+
+			//Add to HTTP listener
+			if "" != rex {
+				if r, err := regexp.Compile(rex); err == nil {
+					ac.TpLogInfo("Regexp compiled [%s]", rex)
+					tmp.Pattern = r
+
+					if err = resolvePathParams(ac, &tmp); err != nil {
+						return err
+					}
+
+					h.HandleFunc(r, tmp)
 				} else {
 					ac.TpLogError("Failed to compile regexp [%s]",
 						err.Error())
 				}
 			} else {
-				M_handler.HandleFunc(nil, tmp)
+				h.HandleFunc(nil, tmp)
+			}
+		}
+	}
+
+	return nil
+}
+
+//Un-init function
+func appinit(ac *atmi.ATMICtx) error {
+	//runtime.LockOSThread()
+	M_handler.initMaps()
+
+	initDefaults(&M_defaults)
+
+	M_workers = WORKERS
+	M_openapi_title = OPENAPI_TITLE_DEFAULT
+	M_http2 = UNSET
+
+	if err := ac.TpInit(); err != nil {
+		return errors.New(err.Error())
+	}
+
+	//Get the configuration
+	M_cctag = os.Getenv("NDRX_CCTAG")
+
+	buf, err := getConfig(ac)
+
+	if nil != err {
+		return err
+	}
+
+	//Set the parameters (ip/port/services)
+
+	occs, _ := buf.BOccur(u.EX_CC_KEY)
+	// Load in the config...
+	for occ := 0; occ < occs; occ++ {
+		ac.TpLog(atmi.LOG_DEBUG, "occ %d", occ)
+		fldName, err := buf.BGetString(u.EX_CC_KEY, occ)
+
+		if nil != err {
+			ac.TpLog(atmi.LOG_ERROR, "Failed to get field "+
+				"%d occ %d", u.EX_CC_KEY, occ)
+			return errors.New(err.Error())
+		}
+
+		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
+
+		switch fldName {
+		case "debug":
+			//Set debug configuration string
+			debug, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+			ac.TpLogDebug("Got [%s] = [%s] ", fldName, debug)
+			if err := ac.TpLogConfig((atmi.LOG_FACILITY_NDRX | atmi.LOG_FACILITY_UBF | atmi.LOG_FACILITY_TP),
+				-1, debug, "ROUT", ""); nil != err {
+				ac.TpLogError("Invalid debug config [%s] %d:[%s]",
+					debug, err.Code(), err.Message())
+				return fmt.Errorf("Invalid debug config [%s] %d:[%s]",
+					debug, err.Code(), err.Message())
+			}
+
+			break
+		case "workers":
+			M_workers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "drain_timeout":
+			M_drain_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "pool_wait_timeout":
+			M_pool_wait_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "pool_status_url":
+			M_pool_status_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "openapi_url":
+			M_openapi_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "openapi_title":
+			M_openapi_title, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "gencore":
+			gencore, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+
+			if TRUE == gencore {
+				//Process signals by default handlers
+				ac.TpLogInfo("gencore=1 - SIGSEG signal will be " +
+					"processed by default OS handler")
+				// Have some core dumps...
+				C.signal(11, nil)
+			}
+			break
+		case "port":
+			M_port, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "ip":
+			M_ip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_enable":
+			M_tls_enable, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "tls_cert_file":
+			M_tls_cert_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_key_file":
+			M_tls_key_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_ca_roots":
+			M_tls_ca_roots, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_client_auth":
+			M_tls_client_auth, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "tls_min_version":
+			M_tls_min_version, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "read_timeout":
+			M_read_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "read_header_timeout":
+			M_read_header_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "write_timeout":
+			M_write_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "idle_timeout":
+			M_idle_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "max_header_bytes":
+			M_max_header_bytes, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "http2":
+			M_http2, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "h2c":
+			M_h2c, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "ws_push_event":
+			M_ws_push_event, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "idempotency_max":
+			M_idem_max, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "idempotency_file":
+			M_idem_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "cache_max":
+			M_cache_max, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "reload_url":
+			M_reload_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "admin_route":
+			M_admin_route, _ = buf.BGetByteArr(u.EX_CC_VALUE, occ)
+			break
+		case "listeners":
+			jsonListeners, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
+
+			if err := parseListeners(ac, jsonListeners); nil != err {
+				return err
 			}
+			break
+		case "defaults":
+			//Override the defaults
+			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
+
+			if err := parseDefaults(ac, jsonDefault, &M_defaults); nil != err {
+				return err
+			}
+
+			break
 		}
 	}
 
-	if atmi.FAIL == M_port || "" == M_ip {
-		ac.TpLog(atmi.LOG_ERROR, "Invalid config: missing ip (%s) or port (%d)",
-			M_ip, M_port)
-		return errors.New("Invalid config: missing ip or port")
+	//Legacy ip/port settings define the default listener
+	if atmi.FAIL != M_port || "" != M_ip {
+		addDefaultListener(ac)
 	}
 
-	//Check the TLS settings
-	if TRUE == M_tls_enable && (M_tls_cert_file == "" || M_tls_key_file == "") {
+	//Check the listeners (incl. TLS settings), routes are bound to them
+	if err := validateListeners(ac); nil != err {
+		return err
+	}
+
+	//Add the default erorr mappings, inherited by routes
+	defaultErrorMap(&M_defaults)
 
-		ac.TpLog(atmi.LOG_ERROR, "Invalid TLS settigns missing cert "+
-			"(%s) or keyfile (%s) ", M_tls_cert_file, M_tls_key_file)
+	var cnt routeCounts
+
+	if err := loadRoutes(ac, buf, &M_defaults, &M_handler, &cnt, false); nil != err {
+		return err
+	}
 
-		return errors.New("Invalid config: missing ip or port")
+	if cnt.metrics > 0 {
+		M_metrics.enabled.Store(true)
 	}
 
+	//Resources created at startup, checked by reload
+	M_routeCounts = cnt
+
 	if M_defaults.Parsecookies && !M_defaults.Parseheaders {
 		return errors.New("Invalid config: parsecookies works only in parseheader mode")
 	}
 
-	//Add the default erorr mappings
-	if M_defaults.Errors_fmt_http_map_str == "" {
+	if err := initAdminRoute(ac); nil != err {
+		return err
+	}
 
-		//https://golang.org/src/net/http/status.go
-		M_defaults.Errors_fmt_http_map = make(map[string]int)
-		//Accepted
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPMINVAL)] =
-			http.StatusOK
-		//Errors:
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEABORT)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBADDESC)] =
-			http.StatusBadRequest
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEBLOCK)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEINVAL)] =
-			http.StatusBadRequest
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPELIMIT)] =
-			http.StatusRequestEntityTooLarge
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPENOENT)] =
-			http.StatusNotFound
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOS)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPERM)] =
-			http.StatusUnauthorized
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEPROTO)] =
-			http.StatusBadRequest
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCERR)] =
-			http.StatusBadGateway
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESVCFAIL)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPESYSTEM)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETIME)] =
-			http.StatusGatewayTimeout
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPETRAN)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERMERR)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEITYPE)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEOTYPE)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPERELEASE)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHAZARD)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEHEURISTIC)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEEVENT)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMATCH)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEDIAGNOSTIC)] =
-			http.StatusInternalServerError
-		M_defaults.Errors_fmt_http_map[strconv.Itoa(atmi.TPEMIB)] =
-			http.StatusInternalServerError
-		//Anything other goes to server error.
-		M_defaults.Errors_fmt_http_map["*"] = http.StatusInternalServerError
+	if "" != M_pool_status_url {
+		ac.TpLogInfo("Pool status end-point: [%s]", M_pool_status_url)
+		M_handler.handleBuiltin(M_pool_status_url, poolStatus)
+	}
+
+	if "" != M_openapi_url {
+		doc, err := genOpenAPI(ac, &M_handler)
+
+		if nil != err {
+			return err
+		}
+
+		M_openapi.Store(doc)
 
+		ac.TpLogInfo("OpenAPI end-point: [%s]", M_openapi_url)
+		M_handler.handleBuiltin(M_openapi_url, serveOpenAPI)
 	}
 
+	if "" != M_reload_url {
+		ac.TpLogInfo("Configuration reload end-point: [%s]", M_reload_url)
+		M_handler.handleBuiltin(M_reload_url, reloadRoute)
+	}
+
+	//Stored responses are loaded before serving
+	if cnt.idem > 0 {
+		if err := initIdemStore(ac); nil != err {
+			return err
+		}
+	}
+
+	initServers(ac)
+
 	ac.TpLogInfo("About to init woker pool, number of workers: %d", M_workers)
 
 	initPool(ac)
 
+	//Transactions need open resource managers
+	if cnt.tx > 0 {
+		if err := initTxPool(ac); nil != err {
+			return err
+		}
+	}
+
+	//Push messages to WebSocket clients
+	if cnt.ws > 0 {
+		if err := initWebSocketPush(ac); nil != err {
+			return err
+		}
+	}
+
+	//Event subscriptions of SSE routes
+	if len(M_sse.streams) > 0 {
+		if err := initSsePoll(ac); nil != err {
+			return err
+		}
+	}
+
 	return nil
 }
 
 //Un-init & Terminate the application
+//Contexts which are still busy (drain timeout expired) are not terminated
 func unInit(ac *atmi.ATMICtx, retCode int) {
 
 	for i := 0; i < M_workers; i++ {
-		nr := <-M_freechan
-
-		ac.TpLogWarn("Terminating %d context", nr)
-		M_ctxs[nr].TpTerm()
-		M_ctxs[nr].FreeATMICtx()
+		select {
+		case nr := <-M_freechan:
+			ac.TpLogWarn("Terminating %d context", nr)
+			if M_txopen {
+				M_ctxs[nr].TpClose()
+			}
+			M_ctxs[nr].TpTerm()
+			M_ctxs[nr].FreeATMICtx()
+		default:
+			ac.TpLogError("XATMI context still busy after drain - not terminated")
+		}
 	}
 
 	ac.TpTerm()
@@ -927,15 +1700,34 @@ func unInit(ac *atmi.ATMICtx, retCode int) {
 }
 
 //Handle the shutdown
+//Stop accepting new connections and wait for in-flight requests to complete
+//(up to drain_timeout). When done, main thread terminates the XATMI contexts.
 func handleShutdown(ac *atmi.ATMICtx) {
 	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-signalChannel
-		//Shutdown all contexts...
-		ac.TpLogWarn("Got signal %d - shutting down all XATMI client contexts",
-			sig)
-		unInit(ac, atmi.SUCCEED)
+
+		ac.TpLogWarn("Got signal %d - stopping listeners, draining requests "+
+			"(max %d sec)", sig, M_drain_timeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(M_drain_timeout)*time.Second)
+		defer cancel()
+
+		//Event streams are open until closed by server
+		sseShutdown(ac)
+
+		if err := shutdownListeners(ac, ctx); nil != err {
+			ac.TpLogError("Failed to drain in-flight requests: %s", err)
+		} else {
+			ac.TpLogWarn("All in-flight requests completed")
+		}
+
+		//WebSocket connections are not tracked by the HTTP servers
+		wsShutdown(ac)
+
+		close(M_drained)
 	}()
 }
 
@@ -957,6 +1749,7 @@ func main() {
 	}
 
 	handleShutdown(M_ac)
+	handleReload(M_ac)
 
 	M_ac.TpLogWarn("REST Incoming init ok - serving...")
 
@@ -964,6 +1757,10 @@ func main() {
 		unInit(M_ac, atmi.FAIL)
 	}
 
+	//Listeners are closed, wait for drain to complete
+	<-M_drained
+
+	M_ac.TpLogWarn("Shutting down all XATMI client contexts")
 	unInit(M_ac, atmi.SUCCEED)
 }
 
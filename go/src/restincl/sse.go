@@ -0,0 +1,462 @@
+/**
+ * @brief Server-Sent Events streams fed from XATMI events
+ *
+ * @file sse.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	SSE_KEEPALIVE_DEFAULT = 15                     //Keep-alive comment interval, seconds
+	SSE_CLIENT_QUEUE      = 64                     //Events queued per client
+	SSE_POLL              = 100 * time.Millisecond //Event notifications check interval
+)
+
+//Event stream of the route, shared by connected clients
+type sseStream struct {
+	url          string               //Route URL
+	event        string               //Event expression subscribed
+	filter       string               //Event filter
+	name         string               //SSE event name, empty - not sent
+	viewFlags    int64                //VIEW to JSON conversion flags
+	ac           *atmi.ATMICtx        //Context receiving the events
+	subscription int64                //Event subscription id
+	mu           sync.Mutex           //Protects clients and seq
+	clients      map[chan []byte]bool //Connected clients, by event queue
+	seq          int64                //Last event id
+}
+
+//Event streams
+var M_sse struct {
+	streams []*sseStream
+	cur     *sseStream //Stream being polled, used by unsolicited handler
+	stop    chan bool  //Closed on shutdown, ends streams and polling
+	done    chan bool  //Polling stopped
+}
+
+//Validate SSE route settings and register the stream
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initSse(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Sse_event {
+		ac.TpLogError("Route [%s]: sse_event must be set for sse route", svc.Url)
+		return fmt.Errorf("Route [%s]: sse_event must be set for sse route",
+			svc.Url)
+	}
+
+	if err := sseKeepalive(ac, svc); nil != err {
+		return err
+	}
+
+	svc.Sse = &sseStream{url: svc.Url, event: svc.Sse_event,
+		filter: svc.Sse_filter, name: svc.Sse_name, viewFlags: svc.View_flags,
+		clients: make(map[chan []byte]bool)}
+
+	M_sse.streams = append(M_sse.streams, svc.Sse)
+
+	if nil == M_sse.stop {
+		M_sse.stop = make(chan bool)
+	}
+
+	ac.TpLogInfo("Route [%s]: event stream of [%s] filter [%s]",
+		svc.Url, svc.Sse_event, svc.Sse_filter)
+
+	return nil
+}
+
+//Validate keep-alive interval of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func sseKeepalive(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if UNSET == svc.Sse_keepalive {
+		svc.Sse_keepalive = SSE_KEEPALIVE_DEFAULT
+	} else if svc.Sse_keepalive < 0 {
+		ac.TpLogError("Route [%s]: invalid sse_keepalive %d", svc.Url,
+			svc.Sse_keepalive)
+		return fmt.Errorf("Route [%s]: invalid sse_keepalive %d", svc.Url,
+			svc.Sse_keepalive)
+	}
+
+	return nil
+}
+
+//Use the stream subscribed at startup, when configuration is reloaded.
+//Subscription of the route cannot be changed without restart
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func sseReuse(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if err := sseKeepalive(ac, svc); nil != err {
+		return err
+	}
+
+	for _, s := range M_sse.streams {
+		if s.url == svc.Url && s.event == svc.Sse_event &&
+			s.filter == svc.Sse_filter && s.name == svc.Sse_name &&
+			s.viewFlags == svc.View_flags {
+			svc.Sse = s
+			return nil
+		}
+	}
+
+	ac.TpLogError("Route [%s]: new or changed sse route requires restart",
+		svc.Url)
+	return fmt.Errorf("Route [%s]: new or changed sse route requires restart",
+		svc.Url)
+}
+
+//Add client to the stream
+//@return channel receiving formatted events
+func (s *sseStream) join() chan []byte {
+
+	ch := make(chan []byte, SSE_CLIENT_QUEUE)
+
+	s.mu.Lock()
+	s.clients[ch] = true
+	s.mu.Unlock()
+
+	return ch
+}
+
+//Remove client from the stream
+//@param ch client channel
+func (s *sseStream) leave(ch chan []byte) {
+
+	s.mu.Lock()
+	delete(s.clients, ch)
+	s.mu.Unlock()
+}
+
+//Send event to all clients. Client which does not keep up (queue full)
+//is disconnected, so that slow readers do not hold the events
+//@param ac ATMI Context
+//@param data event data
+func (s *sseStream) broadcast(ac *atmi.ATMICtx, data []byte) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+
+	var msg bytes.Buffer
+
+	msg.WriteString("id: " + strconv.FormatInt(s.seq, 10) + "\n")
+
+	if "" != s.name {
+		msg.WriteString("event: " + s.name + "\n")
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		msg.WriteString("data: ")
+		msg.Write(bytes.TrimRight(line, "\r"))
+		msg.WriteString("\n")
+	}
+
+	msg.WriteString("\n")
+
+	for ch := range s.clients {
+		select {
+		case ch <- msg.Bytes():
+		default:
+			ac.TpLogWarn("Route [%s]: client queue full - disconnecting", s.url)
+			delete(s.clients, ch)
+			close(ch)
+		}
+	}
+
+	ac.TpLogInfo("Route [%s]: event %d sent to %d clients", s.url, s.seq,
+		len(s.clients))
+}
+
+//Convert event buffer to JSON, by the response conversion of the buffer type
+//@param ac ATMI Context
+//@param tb event buffer
+//@param s stream
+//@return JSON data or nil, if buffer cannot be converted
+func sseConvert(ac *atmi.ATMICtx, tb atmi.TypedBuffer, s *sseStream) []byte {
+
+	var itype, subtype string
+	var buf atmi.TypedBuffer
+	var errA atmi.ATMIError
+
+	if _, errA = ac.TpTypes(tb.GetBuf(), &itype, &subtype); nil != errA {
+		ac.TpLogError("Failed to get event buffer type: %s", errA.Message())
+		return nil
+	}
+
+	//No error fields are added, response is just the converted buffer
+	svc := ServiceMap{View_flags: s.viewFlags}
+
+	switch itype {
+	case "UBF":
+		svc.Conv_int = CONV_JSON2UBF
+		buf, errA = ac.CastToUBF(tb.GetBuf())
+	case "JSON":
+		svc.Conv_int = CONV_JSON
+		buf, errA = ac.CastToJSON(tb.GetBuf())
+	case "VIEW":
+		svc.Conv_int = CONV_JSON2VIEW
+		buf, errA = ac.CastToVIEW(tb.GetBuf())
+	case "STRING":
+		bufs, errS := ac.CastToString(tb.GetBuf())
+
+		if nil != errS {
+			ac.TpLogError("Failed to cast event buffer: %s", errS.Message())
+			return nil
+		}
+
+		data, _ := json.Marshal(bufs.GetString())
+		return data
+	default:
+		ac.TpLogError("Event buffer type [%s] not supported", itype)
+		return nil
+	}
+
+	if nil != errA {
+		ac.TpLogError("Failed to cast event buffer: %s", errA.Message())
+		return nil
+	}
+
+	rsp := wsResponse{hdr: make(http.Header)}
+	genRsp(ac, buf, &svc, &rsp, nil, false, false, false, &RequestContext{})
+
+	if 0 == rsp.body.Len() {
+		ac.TpLogError("Failed to convert [%s] event buffer to JSON", itype)
+		return nil
+	}
+
+	return rsp.body.Bytes()
+}
+
+//Event notification handler, forwards the event to stream being polled
+//@param ac ATMI Context
+//@param tb event buffer
+func sseEvent(ac *atmi.ATMICtx, tb atmi.TypedBuffer) {
+
+	s := M_sse.cur
+
+	if nil == s {
+		ac.TpLogWarn("Event received out of stream poll - dropping")
+		return
+	}
+
+	if data := sseConvert(ac, tb, s); nil != data {
+		s.broadcast(ac, data)
+	}
+}
+
+//Subscribe the streams to events and start receiving them. Each stream has
+//dedicated XATMI context, thus events are told apart by the context polled
+//@param ac ATMI Context
+//@return error
+func initSsePoll(ac *atmi.ATMICtx) error {
+
+	for _, s := range M_sse.streams {
+
+		sac, errA := atmi.NewATMICtx()
+
+		if nil != errA {
+			ac.TpLogError("Failed to create event context: %s", errA.Message())
+			return errA
+		}
+
+		s.ac = sac
+
+		if errA = sac.TpSetUnsol(sseEvent); nil != errA {
+			ac.TpLogError("Failed to set unsolicited handler: %s", errA.Message())
+			return errA
+		}
+
+		if s.subscription, errA = sac.TpSubscribe(s.event, s.filter,
+			nil, 0); nil != errA {
+			ac.TpLogError("Route [%s]: failed to subscribe to [%s]: %s",
+				s.url, s.event, errA.Message())
+			return errA
+		}
+
+		ac.TpLogInfo("Route [%s]: subscribed to [%s], subscription %d",
+			s.url, s.event, s.subscription)
+	}
+
+	M_sse.done = make(chan bool)
+
+	go func() {
+		defer close(M_sse.done)
+
+		for {
+			select {
+			case <-M_sse.stop:
+				return
+			case <-time.After(SSE_POLL):
+				//Handler is invoked synchronously from TpChkUnsol
+				for _, s := range M_sse.streams {
+					M_sse.cur = s
+					s.ac.TpChkUnsol()
+				}
+				M_sse.cur = nil
+			}
+		}
+	}()
+
+	return nil
+}
+
+//Serve the event stream route: authenticate and send the events
+//until client disconnects or server shuts down
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+func sseRoute(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
+
+	//Rate limit applies to connection attempts, max_inflight caps streams
+	if !limitFilter(w, req, &svc) {
+		return
+	}
+
+	defer svc.Limiter.release()
+
+	req, ok := authFilter(w, req, &svc)
+
+	if !ok {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	//Stream is open longer than write_timeout
+	if err := rc.SetWriteDeadline(time.Time{}); nil != err {
+		M_ac.TpLogDebug("Route [%s]: write deadline not reset: %s", svc.Url, err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := rc.Flush(); nil != err {
+		M_ac.TpLogError("Route [%s]: streaming not supported: %s", svc.Url, err)
+		return
+	}
+
+	s := svc.Sse
+	ch := s.join()
+	defer s.leave(ch)
+
+	M_ac.TpLogInfo("Route [%s]: client %s connected", svc.Url, req.RemoteAddr)
+
+	var keepalive <-chan time.Time
+
+	if svc.Sse_keepalive > 0 {
+		t := time.NewTicker(time.Duration(svc.Sse_keepalive) * time.Second)
+		defer t.Stop()
+		keepalive = t.C
+	}
+
+	for {
+		var msg []byte
+
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-keepalive:
+			msg = []byte(": keepalive\n\n")
+		case <-req.Context().Done():
+			M_ac.TpLogInfo("Route [%s]: client %s disconnected", svc.Url,
+				req.RemoteAddr)
+			return
+		case <-M_sse.stop:
+			return
+		}
+
+		if _, err := w.Write(msg); nil != err {
+			M_ac.TpLogWarn("Route [%s]: write to %s failed: %s", svc.Url,
+				req.RemoteAddr, err)
+			return
+		}
+
+		if err := rc.Flush(); nil != err {
+			return
+		}
+	}
+}
+
+//End the event streams and stop receiving events, on shutdown.
+//Called before draining, as streams do not complete by themselves
+//@param ac ATMI Context
+func sseShutdown(ac *atmi.ATMICtx) {
+
+	if nil == M_sse.stop {
+		return
+	}
+
+	close(M_sse.stop)
+
+	if nil != M_sse.done {
+		<-M_sse.done
+	}
+
+	for _, s := range M_sse.streams {
+		if nil == s.ac {
+			continue
+		}
+
+		if _, errA := s.ac.TpUnsubscribe(s.subscription, 0); nil != errA {
+			ac.TpLogWarn("Route [%s]: failed to unsubscribe: %s", s.url,
+				errA.Message())
+		}
+
+		s.ac.TpTerm()
+		s.ac.FreeATMICtx()
+		s.ac = nil
+	}
+
+	ac.TpLogWarn("Event streams closed")
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,180 @@
+/**
+ * @brief Global transactions around the route service call
+ *
+ * @file tran.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	TX_TIMEOUT_DEFAULT = 60 //Default transaction timeout, seconds
+)
+
+var M_txopen bool = false //Resource managers are open on pool contexts
+
+//Validate transaction settings of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initTransaction(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Transaction {
+		return nil
+	}
+
+	if !isCallConv(svc.Conv_int) ||
+		svc.Asynccall || svc.Echo || svc.Download_conv || svc.Upload_conv ||
+		svc.Cache_ttl > 0 {
+		ac.TpLogError("Route [%s]: transaction not supported for conv [%s], "+
+			"async, echo, download_conv, upload_conv or cache_ttl",
+			svc.Url, svc.Conv)
+		return fmt.Errorf("Route [%s]: transaction not supported for conv [%s], "+
+			"async, echo, download_conv, upload_conv or cache_ttl",
+			svc.Url, svc.Conv)
+	}
+
+	if UNSET == svc.Transaction_timeout {
+		svc.Transaction_timeout = TX_TIMEOUT_DEFAULT
+	} else if svc.Transaction_timeout <= 0 {
+		ac.TpLogError("Route [%s]: invalid transaction_timeout %d", svc.Url,
+			svc.Transaction_timeout)
+		return fmt.Errorf("Route [%s]: invalid transaction_timeout %d", svc.Url,
+			svc.Transaction_timeout)
+	}
+
+	ac.TpLogInfo("Route [%s]: called in global transaction, timeout %d sec",
+		svc.Url, svc.Transaction_timeout)
+
+	return nil
+}
+
+//Open resource managers on pool contexts, required for tpbegin
+//@param ac ATMI Context
+//@return error or nil
+func initTxPool(ac *atmi.ATMICtx) error {
+
+	for i, ctx := range M_ctxs {
+		if errA := ctx.TpOpen(); nil != errA {
+			ac.TpLogError("Failed to tpopen context %d: %s", i, errA.Message())
+			return errA
+		}
+	}
+
+	M_txopen = true
+
+	return nil
+}
+
+//Start the transaction of the route
+//@param ac ATMI Context
+//@param svc service map
+//@return ATMI error or nil
+func txBegin(ac *atmi.ATMICtx, svc *ServiceMap) atmi.ATMIError {
+
+	if errA := ac.TpBegin(uint64(svc.Transaction_timeout), 0); nil != errA {
+		ac.TpLogError("Route [%s]: failed to begin transaction: %s",
+			svc.Url, errA.Message())
+		return errA
+	}
+
+	ac.TpLogInfo("Route [%s]: transaction started", svc.Url)
+
+	return nil
+}
+
+//Abort the transaction if still open, i.e. request failed before the
+//service call
+//@param ac ATMI Context
+func txRelease(ac *atmi.ATMICtx) {
+
+	if ac.TpGetLev() > 0 {
+		ac.TpLogWarn("Transaction not completed - aborting")
+
+		if errA := ac.TpAbort(0); nil != errA {
+			ac.TpLogError("Failed to abort transaction: %s", errA.Message())
+		}
+	}
+}
+
+//Complete the transaction by the result of the service call. On call error
+//transaction is aborted, otherwise committed
+//@param ac ATMI Context
+//@param callErr service call error or nil
+//@param rctx request context
+//@return call error, commit error or nil
+func txEnd(ac *atmi.ATMICtx, callErr atmi.ATMIError,
+	rctx *RequestContext) atmi.ATMIError {
+
+	if nil != callErr {
+		ac.TpLogWarn("Service call failed (%d: %s) - aborting transaction",
+			callErr.Code(), callErr.Message())
+
+		if errA := ac.TpAbort(0); nil != errA {
+			ac.TpLogError("Failed to abort transaction: %s", errA.Message())
+		}
+
+		return callErr
+	}
+
+	errA := ac.TpCommit(0)
+
+	if nil == errA {
+		ac.TpLogInfo("Transaction committed")
+		return nil
+	}
+
+	ac.TpLogError("Failed to commit transaction: %d: %s", errA.Code(),
+		errA.Message())
+
+	rctx.errSrc = ERRSRC_TRAN
+
+	switch errA.Code() {
+	case atmi.TPEHAZARD:
+		return atmi.NewCustomATMIError(atmi.TPEHAZARD,
+			"Transaction outcome unknown, may be partially committed: "+
+				errA.Message())
+	case atmi.TPEHEURISTIC:
+		return atmi.NewCustomATMIError(atmi.TPEHEURISTIC,
+			"Transaction heuristically completed, partially committed: "+
+				errA.Message())
+	case atmi.TPEABORT:
+		return atmi.NewCustomATMIError(atmi.TPEABORT,
+			"Transaction rolled back: "+errA.Message())
+	}
+
+	return errA
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,777 @@
+/**
+ * @brief WebSocket routes bridging messages to XATMI services
+ *
+ * @file websocket.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ubftab"
+	"unicode/utf8"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" //RFC 6455 accept key GUID
+
+	//Frame opcodes
+	WS_OP_CONT   = 0x0
+	WS_OP_TEXT   = 0x1
+	WS_OP_BINARY = 0x2
+	WS_OP_CLOSE  = 0x8
+	WS_OP_PING   = 0x9
+	WS_OP_PONG   = 0xA
+
+	//Close status codes
+	WS_CLOSE_NORMAL     = 1000
+	WS_CLOSE_GOING_AWAY = 1001
+	WS_CLOSE_PROTOCOL   = 1002
+	WS_CLOSE_INVALID    = 1007
+	WS_CLOSE_TOO_BIG    = 1009
+
+	WS_CONV_DEFAULT           = "json2ubf"
+	JSON_CONNID_FIELD_DEFAULT = "ConnId"
+	WS_WRITE_TIMEOUT          = 10 * time.Second       //Max time to write a frame
+	WS_PUSH_POLL              = 100 * time.Millisecond //Unsolicited messages check interval
+)
+
+//Protocol error, connection is closed with given code
+type wsError struct {
+	code int
+	msg  string
+}
+
+func (e *wsError) Error() string {
+	return fmt.Sprintf("%d: %s", e.code, e.msg)
+}
+
+//WebSocket connection
+type wsConn struct {
+	id   int64         //Connection id, EX_NETCONNID
+	svc  *ServiceMap   //Route settings
+	conn net.Conn      //Hijacked connection
+	rd   *bufio.Reader //Buffered reader of the connection
+	wmu  sync.Mutex    //Serializes writes of responses and push messages
+}
+
+//Open WebSocket connections and push settings
+var M_ws struct {
+	mu    sync.Mutex
+	conns map[int64]*wsConn
+	seq   int64
+	ac    *atmi.ATMICtx //Context receiving push messages, nil - none
+	stop  chan bool     //Stop the push polling
+	done  chan bool     //Push polling stopped
+}
+
+var M_ws_push_event string //Event subscribed for push messages, empty - none
+
+//Response of the XATMI call, sent back as WebSocket message
+type wsResponse struct {
+	hdr    http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *wsResponse) Header() http.Header {
+	return r.hdr
+}
+
+func (r *wsResponse) WriteHeader(code int) {
+	if 0 == r.status {
+		r.status = code
+	}
+}
+
+func (r *wsResponse) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+//Validate WebSocket route settings
+//@param ac ATMI Context
+//@param svc service map
+//@return error or nil
+func initWebSocket(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Ws_conv {
+		svc.Ws_conv = WS_CONV_DEFAULT
+	}
+
+	svc.Ws_conv_int = M_convs[svc.Ws_conv]
+
+	if CONV_JSON2UBF != svc.Ws_conv_int && CONV_JSON != svc.Ws_conv_int &&
+		CONV_TEXT != svc.Ws_conv_int {
+		ac.TpLogError("Route [%s]: invalid ws_conv [%s], supported: json2ubf, "+
+			"json, text", svc.Url, svc.Ws_conv)
+		return fmt.Errorf("Route [%s]: invalid ws_conv [%s]", svc.Url, svc.Ws_conv)
+	}
+
+	if ERRORS_HTTP == svc.Errors_int || ERRORS_EXT == svc.Errors_int ||
+		ERRORS_JSON2VIEW == svc.Errors_int {
+		ac.TpLogError("Route [%s]: errors [%s] not supported for WebSocket, "+
+			"use json, json2ubf or text", svc.Url, svc.Errors)
+		return fmt.Errorf("Route [%s]: errors [%s] not supported for WebSocket",
+			svc.Url, svc.Errors)
+	}
+
+	if "" == svc.JsonConnidField {
+		svc.JsonConnidField = JSON_CONNID_FIELD_DEFAULT
+	}
+
+	ac.TpLogInfo("Route [%s]: WebSocket, messages converted as [%s] to [%s]",
+		svc.Url, svc.Ws_conv, svc.Svc)
+
+	return nil
+}
+
+//Check is the request WebSocket upgrade
+func isWebSocketUpgrade(req *http.Request) bool {
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, v := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Compute Sec-WebSocket-Accept value
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + WS_GUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+//Check is the WebSocket origin allowed. If route has no cors_origins, only
+//same origin browsers (or clients not sending Origin) are accepted.
+//@param req HTTP request
+//@param svc service map
+//@return true if origin is allowed
+func wsOriginAllowed(req *http.Request, svc *ServiceMap) bool {
+
+	origin := req.Header.Get("Origin")
+
+	if "" == origin {
+		return true
+	}
+
+	if len(svc.Cors_origins) > 0 {
+		return corsAllowed(svc, origin)
+	}
+
+	u, err := url.Parse(origin)
+
+	if nil != err {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+//Perform the opening handshake and take over the connection
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+//@return connection or nil, if handshake failed (response is sent)
+func wsUpgrade(w http.ResponseWriter, req *http.Request, svc *ServiceMap) *wsConn {
+
+	if http.MethodGet != req.Method || !isWebSocketUpgrade(req) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "WebSocket upgrade expected", http.StatusUpgradeRequired)
+		return nil
+	}
+
+	if "13" != req.Header.Get("Sec-WebSocket-Version") {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+
+	if "" == key {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil
+	}
+
+	//Protect against cross-site WebSocket hijacking
+	if !wsOriginAllowed(req, svc) {
+		M_ac.TpLogWarn("URL [%s] WebSocket origin [%s] not allowed, caller: %s",
+			req.URL, req.Header.Get("Origin"), req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil
+	}
+
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		M_ac.TpLogError("URL [%s] connection cannot be hijacked (HTTP/2?)", req.URL)
+		http.Error(w, "WebSocket not supported on this connection",
+			http.StatusHTTPVersionNotSupported)
+		return nil
+	}
+
+	conn, rw, err := hj.Hijack()
+
+	if nil != err {
+		M_ac.TpLogError("URL [%s] failed to hijack connection: %s", req.URL, err)
+		return nil
+	}
+
+	//Server timeouts do not apply to the WebSocket session
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+
+	if err = rw.Flush(); nil != err {
+		M_ac.TpLogError("URL [%s] failed to send handshake: %s", req.URL, err)
+		conn.Close()
+		return nil
+	}
+
+	c := wsConn{svc: svc, conn: conn, rd: rw.Reader}
+
+	M_ws.mu.Lock()
+	M_ws.seq++
+	//Unique over the restincl processes of the node
+	c.id = int64(os.Getpid())<<32 | (M_ws.seq & 0xffffffff)
+	if nil == M_ws.conns {
+		M_ws.conns = make(map[int64]*wsConn)
+	}
+	M_ws.conns[c.id] = &c
+	M_ws.mu.Unlock()
+
+	M_ac.TpLogInfo("URL [%s] WebSocket connection %d open, caller: %s",
+		req.URL, c.id, req.RemoteAddr)
+
+	return &c
+}
+
+//Write single frame
+//@param op opcode
+//@param payload frame data
+//@return error
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+
+	var hdr [10]byte
+	n := 2
+
+	hdr[0] = 0x80 | op
+
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n = 10
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+
+	if _, err := c.conn.Write(hdr[:n]); nil != err {
+		return err
+	}
+
+	_, err := c.conn.Write(payload)
+
+	return err
+}
+
+//Send close frame and close the connection
+//@param code close status
+//@param reason close reason
+func (c *wsConn) close(code int, reason string) {
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	c.writeFrame(WS_OP_CLOSE, payload)
+	c.conn.Close()
+
+	M_ws.mu.Lock()
+	delete(M_ws.conns, c.id)
+	M_ws.mu.Unlock()
+
+	M_ac.TpLogInfo("WebSocket connection %d closed: %d %s", c.id, code, reason)
+}
+
+//Read single frame
+//@param max max data payload size, 0 - no limit, -1 - no more data accepted
+//@return fin flag, opcode, payload, error
+func (c *wsConn) readFrame(max int64) (bool, byte, []byte, error) {
+
+	var hdr [8]byte
+
+	if _, err := io.ReadFull(c.rd, hdr[:2]); nil != err {
+		return false, 0, nil, err
+	}
+
+	fin := 0 != hdr[0]&0x80
+	op := hdr[0] & 0x0f
+
+	if 0 != hdr[0]&0x70 {
+		return false, 0, nil, &wsError{WS_CLOSE_PROTOCOL, "Reserved bits set"}
+	}
+
+	if 0 == hdr[1]&0x80 {
+		return false, 0, nil, &wsError{WS_CLOSE_PROTOCOL, "Client frame not masked"}
+	}
+
+	l := int64(hdr[1] & 0x7f)
+
+	switch l {
+	case 126:
+		if _, err := io.ReadFull(c.rd, hdr[:2]); nil != err {
+			return false, 0, nil, err
+		}
+		l = int64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.rd, hdr[:8]); nil != err {
+			return false, 0, nil, err
+		}
+		l = int64(binary.BigEndian.Uint64(hdr[:8]))
+	}
+
+	if op >= WS_OP_CLOSE && (!fin || l > 125) {
+		return false, 0, nil, &wsError{WS_CLOSE_PROTOCOL, "Invalid control frame"}
+	}
+
+	if l < 0 || (op < WS_OP_CLOSE && 0 != max && l > max) {
+		return false, 0, nil, &wsError{WS_CLOSE_TOO_BIG, "Message too big"}
+	}
+
+	var mask [4]byte
+
+	if _, err := io.ReadFull(c.rd, mask[:]); nil != err {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, l)
+
+	if _, err := io.ReadFull(c.rd, payload); nil != err {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, op, payload, nil
+}
+
+//Read the data message, control frames are processed meanwhile
+//@return message, error (io.EOF if closed by peer)
+func (c *wsConn) readMessage() ([]byte, error) {
+
+	var msg []byte
+	var msgOp byte
+	max := bodyLimit(c.svc)
+
+	for {
+		left := int64(0)
+
+		if max > 0 {
+			left = max - int64(len(msg))
+			if left <= 0 {
+				left = -1
+			}
+		}
+
+		fin, op, payload, err := c.readFrame(left)
+
+		if nil != err {
+			return nil, err
+		}
+
+		switch op {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, payload); nil != err {
+				return nil, err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			return nil, io.EOF
+		case WS_OP_TEXT, WS_OP_BINARY:
+			if 0 != msgOp {
+				return nil, &wsError{WS_CLOSE_PROTOCOL, "Fragmented message expected"}
+			}
+			msgOp = op
+		case WS_OP_CONT:
+			if 0 == msgOp {
+				return nil, &wsError{WS_CLOSE_PROTOCOL, "Unexpected continuation"}
+			}
+		default:
+			return nil, &wsError{WS_CLOSE_PROTOCOL, "Unknown opcode"}
+		}
+
+		msg = append(msg, payload...)
+
+		if fin {
+			if WS_OP_TEXT == msgOp && !utf8.Valid(msg) {
+				return nil, &wsError{WS_CLOSE_INVALID, "Invalid UTF-8 text"}
+			}
+			return msg, nil
+		}
+	}
+}
+
+//Add connection id to the JSON object message. Connection id sent by
+//client is replaced (in any spelling of the key), so that other connection
+//cannot be addressed.
+//@param msg JSON object
+//@param key connection id key
+//@param id connection id
+//@return message with connection id, error if message with connection id
+//is not valid JSON
+func wsAddConnID(msg []byte, key string, id int64) ([]byte, error) {
+
+	trimmed := bytes.TrimSpace(msg)
+
+	if len(trimmed) < 2 || '{' != trimmed[0] {
+		return msg, nil
+	}
+
+	//Always decoded, key may be written with escapes, e.g. \u0044
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&obj); nil != err {
+		return nil, &wsError{WS_CLOSE_INVALID, "Invalid JSON message"}
+	}
+
+	obj[key] = id
+
+	return json.Marshal(obj)
+}
+
+//Call the service with the message and send the response back
+//@param req upgrade request, used as template for the service request
+//@param msg message received
+//@return error if connection failed or message is invalid
+func (c *wsConn) call(req *http.Request, msg []byte) error {
+
+	var err error
+
+	svc := *c.svc
+	svc.Conv_int = svc.Ws_conv_int
+
+	switch svc.Conv_int {
+	case CONV_JSON2UBF:
+		msg, err = wsAddConnID(msg, "EX_NETCONNID", c.id)
+	case CONV_JSON:
+		msg, err = wsAddConnID(msg, svc.JsonConnidField, c.id)
+	}
+
+	if nil != err {
+		return err
+	}
+
+	r := req.Clone(req.Context())
+	r.Method = http.MethodPost
+	r.Body = ioutil.NopCloser(bytes.NewReader(msg))
+	r.ContentLength = int64(len(msg))
+
+	rsp := wsResponse{hdr: make(http.Header)}
+
+	nr := getFreeCtx(svc.Pool_wait_timeout)
+
+	if atmi.FAIL == nr {
+		M_ac.TpLogError("WebSocket %d no free XATMI context in %d ms",
+			c.id, svc.Pool_wait_timeout)
+
+		genHTTPErrRsp(M_ac, &svc, &rsp, http.StatusServiceUnavailable,
+			atmi.NewCustomATMIError(atmi.TPELIMIT, "No free XATMI context"))
+	} else {
+		handleMessage(poolCtx(nr), &svc, &rsp, r)
+		M_freechan <- nr
+	}
+
+	if 0 == rsp.body.Len() {
+		return nil
+	}
+
+	return c.writeFrame(WS_OP_TEXT, rsp.body.Bytes())
+}
+
+//Serve the WebSocket route: authenticate, upgrade and process messages
+//until connection is closed. Messages are processed in order of arrival.
+//@param w response writer
+//@param req HTTP request
+//@param svc service map
+func websocketRoute(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
+
+	//Rate limit applies to connection attempts, max_inflight caps connections
+	if !limitFilter(w, req, &svc) {
+		return
+	}
+
+	defer svc.Limiter.release()
+
+	req, ok := authFilter(w, req, &svc)
+
+	if !ok {
+		return
+	}
+
+	c := wsUpgrade(w, req, &svc)
+
+	if nil == c {
+		return
+	}
+
+	for {
+		msg, err := c.readMessage()
+
+		if nil != err {
+			var werr *wsError
+
+			if errors.As(err, &werr) {
+				M_ac.TpLogError("WebSocket %d protocol error: %s", c.id, werr.msg)
+				c.close(werr.code, werr.msg)
+			} else if io.EOF == err {
+				c.close(WS_CLOSE_NORMAL, "")
+			} else {
+				M_ac.TpLogWarn("WebSocket %d read failed: %s", c.id, err)
+				c.close(WS_CLOSE_GOING_AWAY, "")
+			}
+
+			return
+		}
+
+		M_ac.TpLogDebug("WebSocket %d got message, %d bytes", c.id, len(msg))
+
+		if err = c.call(req, msg); nil != err {
+			var werr *wsError
+
+			if errors.As(err, &werr) {
+				M_ac.TpLogError("WebSocket %d invalid message: %s", c.id, werr.msg)
+				c.close(werr.code, werr.msg)
+			} else {
+				M_ac.TpLogWarn("WebSocket %d write failed: %s", c.id, err)
+				c.close(WS_CLOSE_GOING_AWAY, "")
+			}
+			return
+		}
+	}
+}
+
+//Deliver the unsolicited message (event or notification) to the connection
+//given by EX_NETCONNID (UBF) or route json_connid_field (JSON)
+//@param ac ATMI Context
+//@param tb received buffer
+func wsPush(ac *atmi.ATMICtx, tb atmi.TypedBuffer) {
+
+	var id int64
+	var msg []byte
+	var bufu *atmi.TypedUBF
+	var bufj *atmi.TypedJSON
+
+	if b, errA := ac.CastToUBF(tb.GetBuf()); nil == errA {
+		bufu = b
+		id, _ = bufu.BGetInt64(ubftab.EX_NETCONNID, 0)
+	} else if b, errA := ac.CastToJSON(tb.GetBuf()); nil == errA {
+		bufj = b
+	} else {
+		ac.TpLogError("Push message: unsupported buffer type - dropping")
+		return
+	}
+
+	var obj map[string]json.RawMessage
+
+	if nil != bufj {
+		if err := json.Unmarshal(bufj.GetJSON(), &obj); nil != err {
+			ac.TpLogError("Push message: invalid JSON: %s - dropping", err)
+			return
+		}
+	}
+
+	M_ws.mu.Lock()
+
+	var c *wsConn
+
+	if nil != bufj {
+		//Key depends on the route, check connections in turn
+		for cid, conn := range M_ws.conns {
+			if raw, ok := obj[conn.svc.JsonConnidField]; ok &&
+				strconv.FormatInt(cid, 10) == string(raw) {
+				c = conn
+				id = cid
+				break
+			}
+		}
+	} else {
+		c = M_ws.conns[id]
+	}
+
+	M_ws.mu.Unlock()
+
+	if nil == c {
+		ac.TpLogWarn("Push message: connection %d not found - dropping", id)
+		return
+	}
+
+	switch {
+	case nil != bufj:
+		msg = bufj.GetJSON()
+	case CONV_JSON2UBF == c.svc.Ws_conv_int:
+		js, errA := bufu.TpUBFToJSON()
+		if nil != errA {
+			ac.TpLogError("Push message: failed to convert UBF to JSON: %s",
+				errA.Message())
+			return
+		}
+		msg = []byte(js)
+	default:
+		msg, _ = bufu.BGetByteArr(ubftab.EX_IF_RSPDATA, 0)
+	}
+
+	ac.TpLogInfo("Push message to WebSocket %d, %d bytes", id, len(msg))
+
+	if err := c.writeFrame(WS_OP_TEXT, msg); nil != err {
+		ac.TpLogWarn("WebSocket %d push failed: %s", id, err)
+		c.conn.Close()
+	}
+}
+
+//Start receiving push messages for WebSocket connections. Dedicated XATMI
+//context receives unsolicited messages (tpnotify/tpbroadcast) and, if
+//ws_push_event is set, the events posted with tppost
+//@param ac ATMI Context
+//@return error
+func initWebSocketPush(ac *atmi.ATMICtx) error {
+
+	pac, errA := atmi.NewATMICtx()
+
+	if nil != errA {
+		ac.TpLogError("Failed to create push context: %s", errA.Message())
+		return errA
+	}
+
+	if errA = pac.TpSetUnsol(wsPush); nil != errA {
+		ac.TpLogError("Failed to set unsolicited handler: %s", errA.Message())
+		return errA
+	}
+
+	if "" != M_ws_push_event {
+		if _, errA = pac.TpSubscribe(M_ws_push_event, "", nil, 0); nil != errA {
+			ac.TpLogError("Failed to subscribe to [%s]: %s",
+				M_ws_push_event, errA.Message())
+			return errA
+		}
+
+		ac.TpLogInfo("WebSocket push subscribed to [%s]", M_ws_push_event)
+	}
+
+	M_ws.ac = pac
+	M_ws.stop = make(chan bool)
+	M_ws.done = make(chan bool)
+
+	go func() {
+		defer close(M_ws.done)
+
+		for {
+			select {
+			case <-M_ws.stop:
+				return
+			case <-time.After(WS_PUSH_POLL):
+				pac.TpChkUnsol()
+			}
+		}
+	}()
+
+	return nil
+}
+
+//Close WebSocket connections and stop the push processing, on shutdown
+//@param ac ATMI Context
+func wsShutdown(ac *atmi.ATMICtx) {
+
+	if nil != M_ws.ac {
+		close(M_ws.stop)
+		<-M_ws.done
+		M_ws.ac.TpTerm()
+		M_ws.ac.FreeATMICtx()
+		M_ws.ac = nil
+	}
+
+	M_ws.mu.Lock()
+	conns := make([]*wsConn, 0, len(M_ws.conns))
+	for _, c := range M_ws.conns {
+		conns = append(conns, c)
+	}
+	M_ws.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(WS_CLOSE_GOING_AWAY, "Server shutdown")
+	}
+
+	if len(conns) > 0 {
+		ac.TpLogWarn("Closed %d WebSocket connections", len(conns))
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
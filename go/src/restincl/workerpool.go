@@ -40,6 +40,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"encoding/base64"
 	"os"
@@ -68,7 +70,10 @@ Workes will wait on <-M_waitjobchan[M_workers], when complete they will do Nr ->
 
 var M_freechan chan int //List of free channels submitted by wokers
 
-var M_ctxs []*atmi.ATMICtx //List of contexts
+var M_ctxs []*atmi.ATMICtx //List of contexts, nil - retired by pool shrink
+var M_ctxsmu sync.RWMutex  //Protects M_ctxs, while pool is resized
+
+var M_poolwaiting int64 //Number of requests waiting for free context
 
 // Generates a file form a Base64 string and writes it to response
 func generateFileFromBase64(fileContentsB64 string, tmpFileName string, w http.ResponseWriter) {
@@ -231,6 +236,27 @@ func genRspHeaders(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, w http.ResponseWriter,
 	return ret
 }
 
+//Map XATMI error code to HTTP status by route error mapping
+//@param svc service map
+//@param code XATMI error code
+//@return HTTP status code
+func mapHTTPCode(svc *ServiceMap, code int) int {
+
+	var lookup map[string]int
+	//Map the resposne codes
+	if len(svc.Errors_fmt_http_map) > 0 {
+		lookup = svc.Errors_fmt_http_map
+	} else {
+		lookup = M_defaults.Errors_fmt_http_map
+	}
+
+	if httpCode := lookup[strconv.Itoa(code)]; 0 != httpCode {
+		return httpCode
+	}
+
+	return lookup["*"]
+}
+
 //Generate response in the service configured way...
 //@w	handler for writting response to
 //if postSvc is set to true, that indicates that service was called and now
@@ -287,7 +313,12 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 		if !ok {
 			ac.TpLogError("Invalid response buffer, not UBF!")
-			w.WriteHeader(500)
+
+			if 0 != rctx.httpCode {
+				w.WriteHeader(rctx.httpCode)
+			} else {
+				w.WriteHeader(500)
+			}
 			break
 		}
 
@@ -358,6 +389,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 			netCode, _ = bufu.BGetInt(ubftab.EX_NETRCODE, 0)
 
+			//Forced status, if not set by the error filters
+			if 0 == netCode && 0 != rctx.httpCode {
+				netCode = rctx.httpCode
+			}
+
 			if 0 == netCode {
 				ac.TpLogError("Invalid EX_NETRCODE or not set => return http 500")
 				w.WriteHeader(500)
@@ -469,6 +505,38 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			}
 		}
 
+		break
+	case CONV_XML2UBF:
+		rspType = "application/xml"
+		//Convert buffer back to XML, errors are added by errors mode
+
+		bufu, ok := buf.(*atmi.TypedUBF)
+
+		if svc.Asynccall && !svc.Asyncecho {
+			ac.TpLogInfo("Async mode, no echo")
+		} else if !ok {
+			ac.TpLogError("Failed to cast TypedBuffer to TypedUBF!")
+
+			if err.Code() == atmi.TPMINVAL {
+				err = atmi.NewCustomATMIError(atmi.TPESYSTEM, "Invalid buffer")
+			}
+		} else {
+
+			//Process headers
+			genRspHeaders(ac, bufu, w, svc)
+
+			// Delete Header and Cookie data from buffer (req&rsp)
+			bufu.BDelete(delFldList)
+
+			ret, err1 := ubfToXML(ac, bufu, svc.Xml_root)
+
+			if nil == err1 {
+				rsp = ret
+			} else if err.Code() == atmi.TPMINVAL {
+				err = err1
+			}
+		}
+
 		break
 	case CONV_JSON2VIEW:
 		rspType = "application/json"
@@ -657,8 +725,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 			if !ok {
 				ac.TpLogError("Failed to cast buffer to TypedJSON")
-				err = atmi.NewCustomATMIError(atmi.TPEINVAL,
-					"Failed to cast buffer to TypedJSON")
+
+				if err.Code() == atmi.TPMINVAL {
+					err = atmi.NewCustomATMIError(atmi.TPEINVAL,
+						"Failed to cast buffer to TypedJSON")
+				}
 			} else {
 				//Set the bytes to string we got
 				rsp = []byte(bufs.GetJSON())
@@ -746,22 +817,10 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 	w.Header().Set("Content-Type", rspType)
 	switch svc.Errors_int {
 	case ERRORS_HTTP:
-		var lookup map[string]int
-		//Map the resposne codes
-		if len(svc.Errors_fmt_http_map) > 0 {
-			lookup = svc.Errors_fmt_http_map
-		} else {
-			lookup = M_defaults.Errors_fmt_http_map
-		}
-
-		estr := strconv.Itoa(err.Code())
+		httpCode := rctx.httpCode
 
-		httpCode := 500
-
-		if 0 != lookup[estr] {
-			httpCode = lookup[estr]
-		} else {
-			httpCode = lookup["*"]
+		if 0 == httpCode {
+			httpCode = mapHTTPCode(svc, err.Code())
 		}
 
 		//Generate error response and pop out of the funcion
@@ -828,14 +887,47 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			rsp = []byte(strrsp)
 		}
 
+		break
+	case ERRORS_XML:
+		//Add error elements to the XML document
+
+		if atmi.TPMINVAL == err.Code() && !svc.Errfmt_xml_onsucc && !svc.Asyncecho {
+			break //Do no generate on success.
+		}
+
+		rsp = xmlAddError(svc, rsp, err)
+		ac.TpLogDebug("XML Response generated: [%s]", string(rsp))
+
+		break
+	case ERRORS_PROBLEM:
+		//Problem details replace the response, success is sent as is
+		if atmi.TPMINVAL == err.Code() {
+			break
+		}
+
+		if 0 == rctx.httpCode {
+			rctx.httpCode = mapHTTPCode(svc, err.Code())
+		}
+
+		rspType = PROBLEM_CONTENT_TYPE
+		w.Header().Set("Content-Type", rspType)
+		rsp = genProblem(ac, svc, w, rctx.httpCode, err, rctx.errSrc)
+
 		break
 	}
 
 	//Send response back
+	setRspATMICode(w, err.Code())
 	ac.TpLogDebug("Returning context type: %s, len: %d", rspType, len(rsp))
 	ac.TpLogDump(atmi.LOG_DEBUG, "Sending response back", rsp, len(rsp))
 	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
 
+	//Forced status for errors formatted in response body
+	if 0 != rctx.httpCode && ERRORS_HTTP != svc.Errors_int &&
+		CONV_EXT != svc.Conv_int {
+		w.WriteHeader(rctx.httpCode)
+	}
+
 	if svc.Stream {
 		w.Write([]byte("OK"))
 	} else {
@@ -843,6 +935,83 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 	}
 }
 
+//Escape the text for JSON string value
+//@param s text
+//@return escaped text, without quotes
+func jsonEscape(s string) string {
+
+	b, _ := json.Marshal(s)
+
+	return string(b[1 : len(b)-1])
+}
+
+//Generate error response with given HTTP status code, used when request is
+//rejected by rest-in before service call (no XATMI buffers are involved).
+//Response body is formatted according to route error handling mode.
+//@param ac ATMI Context (used for logging)
+//@param svc service map
+//@param w response writer
+//@param httpCode HTTP status code to return
+//@param err error code and message for the response body
+func genHTTPErrRsp(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	httpCode int, err atmi.ATMIError) {
+
+	var rsp string
+	rspType := "text/plain"
+
+	ac.TpLogWarn("Rejecting request with http %d: %d:[%s]",
+		httpCode, err.Code(), err.Message())
+
+	switch svc.Errors_int {
+	case ERRORS_JSON:
+		rspType = "application/json"
+		rsp = fmt.Sprintf("{%s,%s}",
+			fmt.Sprintf(svc.Errfmt_json_code, err.Code()),
+			fmt.Sprintf(svc.Errfmt_json_msg, jsonEscape(err.Message())))
+		break
+	case ERRORS_JSON2UBF:
+		rspType = "application/json"
+		msg, _ := json.Marshal(err.Message())
+		rsp = fmt.Sprintf("{\"EX_IF_ECODE\":%d,\"EX_IF_EMSG\":%s}",
+			err.Code(), msg)
+		break
+	case ERRORS_XML:
+		rspType = "application/xml"
+		rsp = string(xmlAddError(svc, nil, err))
+		break
+	case ERRORS_PROBLEM:
+		rspType = PROBLEM_CONTENT_TYPE
+		rsp = string(genProblem(ac, svc, w, httpCode, err, ERRSRC_RESTIN))
+		break
+	case ERRORS_JSON2VIEW:
+		//Response view object, without VIEW buffer (no XATMI context here)
+		rspType = "application/json"
+		rsp = "{}"
+
+		if "" != svc.Errfmt_view_rsp {
+			obj, _ := json.Marshal(map[string]map[string]interface{}{
+				svc.Errfmt_view_rsp: {svc.Errfmt_view_code: err.Code(),
+					svc.Errfmt_view_msg: err.Message()}})
+			rsp = string(obj)
+		}
+		break
+	case ERRORS_TEXT, ERRORS_RAW, ERRORS_EXT:
+		//ext: no buffer is prepared, thus error filters are not called
+		rsp = fmt.Sprintf(svc.Errfmt_text, err.Code(), err.Message())
+		break
+	default:
+		//http: status carries the error
+		rsp = http.StatusText(httpCode)
+		break
+	}
+
+	setRspATMICode(w, err.Code())
+	w.Header().Set("Content-Type", rspType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
+	w.WriteHeader(httpCode)
+	w.Write([]byte(rsp))
+}
+
 //Common function parsing http request headers
 func parseHeaders(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
 	bufu *atmi.TypedUBF) atmi.UBFError {
@@ -953,17 +1122,38 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 	var buf atmi.TypedBuffer
 	var err atmi.ATMIError
 	do_upload := false //perform file download?
+	abort := false     //abort the response, streaming failed
 	reqlogOpen := false
 	rctx.errSrc = ERRSRC_RESTIN //Default error source rest-in process
 
+	//Temporary files are removed, unless handled by response
+	defer removeUploads(ac, &rctx)
+
 	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s", req.URL, req.RemoteAddr)
 
+	//Reply of enqueued request, no request conversion
+	if svc.Queue_status {
+		queueStatus(ac, svc, w, req)
+		return atmi.SUCCEED
+	}
+
 	if "" != svc.Svc || svc.Echo {
 
 		var body []byte
 		if !svc.Parseform && !svc.Fileupload {
 
-			body, _ = ioutil.ReadAll(req.Body)
+			var errR error
+			body, errR = ioutil.ReadAll(req.Body)
+
+			if isBodyTooLarge(errR) {
+				ac.TpLogError("URL [%s] body exceeds max_body_size, caller: %s",
+					req.URL, req.RemoteAddr)
+				rctx.httpCode = http.StatusRequestEntityTooLarge
+				genRsp(ac, nil, svc, w, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"Request body too large"), false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
 			ac.TpLogDebug("Requesting service [%s] buffer [%s]",
 				svc.Svc, string(body))
 		}
@@ -1036,6 +1226,39 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
+			//Load path parameters
+			if errU := loadPathParamsUBF(ac, svc, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set path parameters %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			//Load client certificate identity (mutual TLS)
+			if errU := loadClientCertUBF(ac, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set client certificate %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			//Load authenticated principal
+			if errU := loadAuthUBF(ac, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set auth principal %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
 			//Load request paramters
 			if errU := parseQuery(ac, svc, req, bufu); nil != errU {
 				ac.TpLogError("Failed to parse/load URL Query params")
@@ -1055,7 +1278,14 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				do_upload = true
 
 			} else if svc.Parseform {
-				if errF := req.ParseForm(); errF != nil {
+				if errF := req.ParseForm(); isBodyTooLarge(errF) {
+					ac.TpLogError("URL [%s] form exceeds max_body_size, caller: %s",
+						req.URL, req.RemoteAddr)
+					rctx.httpCode = http.StatusRequestEntityTooLarge
+					genRsp(ac, nil, svc, w, atmi.NewCustomATMIError(atmi.TPEINVAL,
+						"Request body too large"), false, false, false, &rctx)
+					return atmi.FAIL
+				} else if errF != nil {
 					ac.TpLogError("Failed to parse form: [%s]", errF.Error())
 				} else {
 					ac.TpLogInfo("Form parsed OK")
@@ -1097,8 +1327,8 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 
 			buf = bufu
 			break
-		case CONV_JSON2UBF:
-			//Convert JSON 2 UBF...
+		case CONV_JSON2UBF, CONV_XML2UBF:
+			//Convert JSON/XML 2 UBF...
 			//Bug #200, use max buffer size
 			bufu, err1 := ac.NewUBF(atmi.ATMIMsgSizeMax())
 
@@ -1123,7 +1353,17 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
-			if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
+			if CONV_XML2UBF == svc.Conv_int {
+				if err1 := xmlToUBF(ac, bufu, body); err1 != nil {
+					ac.TpLogError("Failed to conver from XML to UBF %d:[%s]\n",
+						err1.Code(), err1.Message())
+
+					ac.TpLogError("Failed req: [%s]", string(body))
+
+					genRsp(ac, nil, svc, w, err1, false, false, false, &rctx)
+					return atmi.FAIL
+				}
+			} else if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
 				ac.TpLogError("Failed to conver from JSON to UBF %d:[%s]\n",
 					err1.Code(), err1.Message())
 
@@ -1142,6 +1382,38 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				}
 			}
 
+			if errU := loadPathParamsUBF(ac, svc, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set path parameters %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			//Load client certificate identity (mutual TLS)
+			if errU := loadClientCertUBF(ac, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set client certificate %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			//Load authenticated principal
+			if errU := loadAuthUBF(ac, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set auth principal %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
 			buf = bufu
 			break
 		case CONV_JSON2VIEW:
@@ -1206,20 +1478,40 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
-			if svc.Format == "r" || svc.Format == "regexp" || svc.Parseheaders {
-				//Convert JSON to map interface object
-				var jsonObj interface{}
-				decoder := json.NewDecoder(strings.NewReader(string(bufj.GetJSON())))
-				decoder.UseNumber()
-				if err := decoder.Decode(&jsonObj); err != nil {
-					ac.TpLogError("Failed to decode JSON: %v", err.Error())
-					return atmi.FAIL
-				}
-				/*if err := json.Unmarshal([]byte(bufj.GetJSON()), &jsonObj); err != nil {
-					ac.TpLogError("Failed to unmarshal JSON: %v", err.Error())
-					return atmi.FAIL
-				}*/
-				obj := jsonObj.(map[string]interface{})
+			//Identity keys sent by client are removed. Body is always
+			//decoded, as keys may be written with escapes, e.g. \u0041
+			certKey := jsonCertKey(svc)
+			authKey := jsonAuthKey(svc)
+
+			inject := svc.Format == "r" || svc.Format == "regexp" ||
+				svc.Parseheaders || len(svc.Pathparams) > 0 ||
+				nil != requestAuth(req)
+
+			//Convert JSON to map interface object
+			var jsonObj interface{}
+			var obj map[string]interface{}
+			decoder := json.NewDecoder(strings.NewReader(string(bufj.GetJSON())))
+			decoder.UseNumber()
+
+			if errD := decoder.Decode(&jsonObj); nil == errD {
+				obj, _ = jsonObj.(map[string]interface{})
+			} else {
+				ac.TpLogDebug("Request is not valid JSON: %s", errD.Error())
+			}
+
+			if inject && nil == obj {
+				ac.TpLogError("Request is not JSON object, cannot add fields")
+				genRsp(ac, nil, svc, w, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"Invalid JSON request"), false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
+			_, hasCert := obj[certKey]
+			_, hasAuth := obj[authKey]
+
+			if inject || hasCert || hasAuth {
+				delete(obj, certKey)
+				delete(obj, authKey)
 
 				//Add URL to JSON
 				if svc.Format == "r" || svc.Format == "regexp" {
@@ -1230,6 +1522,19 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 					}
 				}
 
+				//Add authenticated principal to JSON
+				if auth := requestAuth(req); nil != auth {
+					obj[authKey] = auth
+				}
+
+				//Add path parameters to JSON
+				values := pathParamValues(svc, req)
+				for _, param := range svc.Pathparams {
+					if value, ok := values[param.Name]; ok {
+						obj[param.Field] = value
+					}
+				}
+
 				// Add header data to UBF fields
 				if svc.Parseheaders {
 					if svc.JsonHeaderField != "" {
@@ -1245,6 +1550,10 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 							obj["Cookie"] = req.Cookies()
 						}
 					}
+					//Add client certificate identity to JSON
+					if cert := clientCertJSON(req); nil != cert {
+						obj[certKey] = cert
+					}
 				}
         
 				//Convert object to JSON
@@ -1293,7 +1602,13 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		//If input filters fails, then generate response immediately...
 		err = nil
 
-		if len(svc.Finman_arr) > 0 {
+		//Filters and the service are called in global transaction
+		if svc.Transaction {
+			err = txBegin(ac, svc)
+			defer txRelease(ac)
+		}
+
+		if nil == err && len(svc.Finman_arr) > 0 {
 			err = runChain(ac, svc, buf, true, svc.Finman_arr,
 				"filter-incoming-mandatory(finman)")
 
@@ -1312,7 +1627,8 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		//So that that it would be possible to reject any possible DOS attacks
 		//against disk full
 		//So the filters can validate headers
-		if do_upload {
+		//Streamed upload (upload_conv) sends the files during the call
+		if do_upload && !svc.Upload_conv {
 			bufu, _ := ac.CastToUBF(buf.GetBuf())
 
 			if errA := handleFileUploadReq(ac, bufu, svc, req, &rctx); nil != errA {
@@ -1326,16 +1642,36 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		} else if svc.Echo {
 			//Do not send service, just echo buffer back
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
+		} else if svc.Asynccall && "" != svc.Queue {
+			//Request is stored in persistent queue
+			err := queueEnqueue(ac, svc, w, buf)
+			rctx.errSrc = ERRSRC_SERVICE
+			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
 		} else if svc.Asynccall {
 			_, err := ac.TpACall(svc.Svc, buf, flags|atmi.TPNOREPLY)
 			//Now service is response for errors
 			rctx.errSrc = ERRSRC_SERVICE
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
+		} else if svc.Download_conv {
+			rctx.errSrc = ERRSRC_SERVICE
+			abort = convDownload(ac, svc, w, buf, flags, reqlogOpen, &rctx)
+		} else if svc.Upload_conv {
+			rctx.errSrc = ERRSRC_SERVICE
+			bufu, _ := ac.CastToUBF(buf.GetBuf())
+			convUpload(ac, svc, w, req, bufu, flags, reqlogOpen, &rctx)
+		} else if cacheable(svc, req) {
+			rctx.errSrc = ERRSRC_SERVICE
+			cachedCall(ac, svc, w, req, buf, flags, reqlogOpen, &rctx)
 		} else {
 			//Now service is response for errors
 			rctx.errSrc = ERRSRC_SERVICE
 			_, err := ac.TpCall(svc.Svc, buf, flags)
 
+			//Outcome of the transaction is the result
+			if svc.Transaction {
+				err = txEnd(ac, err, &rctx)
+			}
+
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, true, &rctx)
 		}
 	}
@@ -1344,13 +1680,25 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		ac.TpLogCloseReqFile()
 	}
 
+	//Response status is sent, only the connection can tell about failure
+	if abort {
+		panic(http.ErrAbortHandler)
+	}
+
 	return atmi.SUCCEED
 }
 
 //Initialise channels and work pools
 func initPool(ac *atmi.ATMICtx) error {
 
-	M_freechan = make(chan int, M_workers)
+	//Pool may grow on reload, up to the channel capacity
+	size := WORKERS_MAX
+
+	if M_workers > size {
+		size = M_workers
+	}
+
+	M_freechan = make(chan int, size)
 
 	for i := 0; i < M_workers; i++ {
 
@@ -1369,4 +1717,146 @@ func initPool(ac *atmi.ATMICtx) error {
 	return nil
 }
 
+//Get the pool context
+//@param nr context number
+//@return ATMI context
+func poolCtx(nr int) *atmi.ATMICtx {
+
+	M_ctxsmu.RLock()
+	defer M_ctxsmu.RUnlock()
+
+	return M_ctxs[nr]
+}
+
+//Get number of workers, pool may be resized by reload
+//@return number of workers
+func poolWorkers() int {
+
+	M_ctxsmu.RLock()
+	defer M_ctxsmu.RUnlock()
+
+	return M_workers
+}
+
+//Grow or shrink the pool to given number of workers. New contexts are
+//submitted as free. Contexts are retired when they become free, thus busy
+//ones complete the requests
+//@param ac ATMI Context
+//@param workers new number of workers
+//@return error or nil
+func resizePool(ac *atmi.ATMICtx, workers int) error {
+
+	M_ctxsmu.Lock()
+	defer M_ctxsmu.Unlock()
+
+	if workers <= 0 || workers > cap(M_freechan) {
+		ac.TpLogError("Invalid workers %d, max %d", workers, cap(M_freechan))
+		return fmt.Errorf("Invalid workers %d, max %d", workers, cap(M_freechan))
+	}
+
+	for M_workers < workers {
+
+		ctx, err := atmi.NewATMICtx()
+
+		if err != nil {
+			ac.TpLogError("Failed to create context: %s", err.Message())
+			return err
+		}
+
+		if M_txopen {
+			if errA := ctx.TpOpen(); nil != errA {
+				ac.TpLogError("Failed to tpopen context: %s", errA.Message())
+				ctx.FreeATMICtx()
+				return errA
+			}
+		}
+
+		//Reuse the retired slot
+		nr := len(M_ctxs)
+
+		for i, c := range M_ctxs {
+			if nil == c {
+				nr = i
+				break
+			}
+		}
+
+		if nr == len(M_ctxs) {
+			M_ctxs = append(M_ctxs, ctx)
+		} else {
+			M_ctxs[nr] = ctx
+		}
+
+		M_workers++
+		ac.TpLogInfo("Added context %d, workers %d", nr, M_workers)
+
+		M_freechan <- nr
+	}
+
+	if M_workers > workers {
+
+		retire := M_workers - workers
+		M_workers = workers
+
+		ac.TpLogInfo("Retiring %d contexts, workers %d", retire, M_workers)
+
+		go func() {
+			for i := 0; i < retire; i++ {
+				nr := <-M_freechan
+
+				M_ctxsmu.Lock()
+				ctx := M_ctxs[nr]
+				M_ctxs[nr] = nil
+				M_ctxsmu.Unlock()
+
+				ctx.TpLogWarn("Terminating %d context", nr)
+
+				if M_txopen {
+					ctx.TpClose()
+				}
+
+				ctx.TpTerm()
+				ctx.FreeATMICtx()
+			}
+		}()
+	}
+
+	return nil
+}
+
+//Get free ATMI context from the pool
+//@param timeout max time to wait in milliseconds, 0 - wait forever
+//@return context number or atmi.FAIL if timeout expired
+func getFreeCtx(timeout int) int {
+
+	atomic.AddInt64(&M_poolwaiting, 1)
+	defer atomic.AddInt64(&M_poolwaiting, -1)
+
+	if timeout <= 0 {
+		return <-M_freechan
+	}
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case nr := <-M_freechan:
+		return nr
+	case <-timer.C:
+		return atmi.FAIL
+	}
+}
+
+//Pool status end-point, returns number of workers, free contexts and
+//requests waiting for free context
+func poolStatus(w http.ResponseWriter, req *http.Request) {
+
+	rsp := fmt.Sprintf("{\"workers\":%d,\"free\":%d,\"waiting\":%d}",
+		poolWorkers(), len(M_freechan), atomic.LoadInt64(&M_poolwaiting))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
+	w.Write([]byte(rsp))
+}
+
 /* vim: set ts=4 sw=4 et smartindent: */
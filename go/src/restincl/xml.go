@@ -0,0 +1,236 @@
+/**
+ * @brief XML document conversion to/from UBF buffers
+ *
+ * @file xml.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Escape the text for XML element
+//@param s text
+//@return escaped text
+func xmlEscape(s string) string {
+
+	var b bytes.Buffer
+
+	xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
+
+//Load XML document into UBF buffer. Elements of the root element are the
+//fields, repeated elements are loaded as occurrences. Carray fields are
+//base64 encoded.
+//@param ac ATMI Context
+//@param bufu UBF buffer
+//@param body XML document
+//@return ATMI error or nil
+func xmlToUBF(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, body []byte) atmi.ATMIError {
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+
+	depth := 0
+	fldid := 0
+	name := ""
+	var value bytes.Buffer
+
+	for {
+		tok, err := d.Token()
+
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			ac.TpLogError("Failed to parse XML: %s", err.Error())
+			return atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Failed to parse XML: %s", err.Error()))
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			if depth > 2 {
+				ac.TpLogError("Nested element [%s] in [%s] not supported",
+					t.Name.Local, name)
+				return atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("Nested element [%s] in [%s] not supported",
+						t.Name.Local, name))
+			} else if 2 == depth {
+
+				name = t.Name.Local
+				value.Reset()
+
+				id, errU := ac.BFldId(name)
+
+				if nil != errU || id <= 0 {
+					ac.TpLogError("Unknown field [%s]", name)
+					return atmi.NewCustomATMIError(atmi.TPEINVAL,
+						fmt.Sprintf("Unknown field [%s]", name))
+				}
+
+				fldid = id
+			}
+			break
+		case xml.CharData:
+			if 2 == depth {
+				value.Write(t)
+			}
+			break
+		case xml.EndElement:
+			if 2 == depth {
+
+				var errU atmi.UBFError
+
+				if atmi.BFLD_CARRAY == ac.BFldType(fldid) {
+
+					data, errB := base64.StdEncoding.DecodeString(
+						strings.TrimSpace(value.String()))
+
+					if nil != errB {
+						ac.TpLogError("Field [%s] invalid base64: %s",
+							name, errB.Error())
+						return atmi.NewCustomATMIError(atmi.TPEINVAL,
+							fmt.Sprintf("Field [%s] invalid base64", name))
+					}
+
+					errU = bufu.BAdd(fldid, data)
+				} else {
+					errU = bufu.BAdd(fldid, value.String())
+				}
+
+				if nil != errU {
+					ac.TpLogError("Failed to add [%s]: %s", name, errU.Error())
+					return atmi.NewCustomATMIError(atmi.TPEINVAL,
+						fmt.Sprintf("Failed to add [%s] %d:[%s]", name,
+							errU.Code(), errU.Message()))
+				}
+			}
+
+			depth--
+			break
+		}
+	}
+
+	return nil
+}
+
+//Generate XML document from UBF buffer
+//@param ac ATMI Context
+//@param bufu UBF buffer
+//@param root root element name
+//@return XML document, ATMI error
+func ubfToXML(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, root string) ([]byte,
+	atmi.ATMIError) {
+
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(fmt.Sprintf("<%s>", root))
+
+	for fldid, occ, errU := bufu.BNext(true); nil == errU && fldid > 0; fldid, occ,
+		errU = bufu.BNext(false) {
+
+		name, errN := ac.BFname(fldid)
+
+		if nil != errN {
+			ac.TpLogError("Failed to get field %d name: %s", fldid, errN.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to get field %d name", fldid))
+		}
+
+		value := ""
+
+		if atmi.BFLD_CARRAY == ac.BFldType(fldid) {
+
+			data, errG := bufu.BGetByteArr(fldid, occ)
+
+			if nil != errG {
+				errN = errG
+			}
+
+			value = base64.StdEncoding.EncodeToString(data)
+		} else {
+
+			str, errG := bufu.BGetString(fldid, occ)
+
+			if nil != errG {
+				errN = errG
+			}
+
+			value = xmlEscape(str)
+		}
+
+		if nil != errN {
+			ac.TpLogError("Failed to get [%s] occ %d: %s", name, occ, errN.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to get [%s] %d:[%s]", name,
+					errN.Code(), errN.Message()))
+		}
+
+		b.WriteString(fmt.Sprintf("<%s>%s</%s>", name, value, name))
+	}
+
+	b.WriteString(fmt.Sprintf("</%s>", root))
+
+	return b.Bytes(), nil
+}
+
+//Add error elements to the XML response, before closing root element.
+//If response is not XML document, document with the errors is generated.
+//@param svc service map
+//@param rsp response
+//@param err error code and message
+//@return response with errors
+func xmlAddError(svc *ServiceMap, rsp []byte, err atmi.ATMIError) []byte {
+
+	errs := fmt.Sprintf(svc.Errfmt_xml_code, err.Code()) +
+		fmt.Sprintf(svc.Errfmt_xml_msg, xmlEscape(err.Message()))
+
+	strrsp := string(rsp)
+
+	if i := strings.LastIndex(strrsp, "</"); i > -1 {
+		return []byte(strrsp[0:i] + errs + strrsp[i:])
+	}
+
+	return []byte(fmt.Sprintf("%s<%s>%s</%s>", xml.Header, svc.Xml_root, errs,
+		svc.Xml_root))
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -28,12 +28,13 @@ rm conf/app.ini 2>/dev/null
 #
 # So we need to add some demo server
 # We need to add server process here + we need to register ubftab (test.fd)
+# and restincl own fields (restin.fd)
 #
 xadmin provision -d \
         -vusv1_name=testsv \
         -vusv1=y \
         -vusv1_sysopt='-e ${NDRX_APPHOME}/log/testsv.log -r' \
-        -vaddubf=test.fd \
+        -vaddubf=test.fd,restin.fd \
         -vucl1=y \
         -vusv1_cmdline=restincl \
         -vusv1_tag=RESTIN \
@@ -48,6 +49,11 @@ rm localhost* 2>/dev/null
 # Generate new ceritificate
 ./gencert.sh localhost 
 
+# Client certificate for mutual TLS
+rm client.* 2>/dev/null
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -batch \
+	-subj "/C=US/O=TEST/CN=client1" -keyout client.key -out client.crt
+
 . settest1
 
 # So we are in runtime directory
@@ -73,6 +79,25 @@ function go_out {
     exit $1
 }
 
+#
+# Config changes done by tests are reverted on exit, also if test fails
+#
+CONF_FILE=`pwd`/conf/restin.ini
+CONF_BACKUP=`pwd`/log/restin.ini.bak
+
+function conf_save {
+    cp $CONF_FILE $CONF_BACKUP
+    trap conf_restore EXIT
+}
+
+function conf_restore {
+    if [ -f $CONF_BACKUP ]; then
+        cp $CONF_BACKUP $CONF_FILE
+        rm -f $CONF_BACKUP
+    fi
+    trap - EXIT
+}
+
 
 ###############################################################################
 echo "Check EXT error filter service fail (tpurcode 3)"
@@ -1143,8 +1168,100 @@ https://localhost:8080/svc1`
 	fi
 done
 } >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Mutual TLS Test"
+###############################################################################
+{
+for i in {1..100}
+do
+
+	RSP=`curl -s --insecure --cert conf/client.crt \
+--key conf/client.key -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"X\"}" https://localhost:8082/mtls/json`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"Subject\":\"CN=client1,O=TEST,C=US\""* ]]; then
+		echo "Client certificate subject not received, got: [$RSP]"
+		go_out 73
+	fi
+
+	# without client certificate handshake must fail
+	curl -s --insecure -X POST -d "{}" https://localhost:8082/mtls/json
+
+	if [ $? -eq 0 ]; then
+		echo "Call without client certificate must fail"
+		go_out 74
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "HTTP/2 over TLS"
+###############################################################################
+{
+	RSP=`curl -s --insecure --http2 -o /dev/null -w "%{http_version}" \
+-H "Content-Type: application/json" -X POST -d "{\"T_STRING_FLD\":\"H2\"}" \
+https://localhost:8080/svc1`
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X2" ]; then
+		echo "Expected HTTP/2 on TLS listener, got: [$RSP]"
+		go_out 75
+	fi
+
+	# disabled explicitly for the listener
+	RSP=`curl -s --insecure --http2 --cert conf/client.crt --key conf/client.key \
+-o /dev/null -w "%{http_version}" -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"X\"}" https://localhost:8082/mtls/json`
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X1.1" ]; then
+		echo "Expected HTTP/1.1 on listener with http2 disabled, got: [$RSP]"
+		go_out 76
+	fi
+} >> $LOGFILE 2>&1
+
+# stops the TLS instance, thus run last
+###############################################################################
+echo "Graceful shutdown, in-flight requests drained"
+###############################################################################
+{
+	curl -s --insecure -H "Content-Type: application/json" -X POST \
+-d "{\"T_STRING_FLD\":\"SLOW\"}" https://localhost:8080/idem/count > log/drain.out &
+	CPID=$!
+
+	# let request to reach the service
+	sleep 1
+	kill -2 $RPID
+	sleep 1
+
+	# listener is closed, new connections are refused
+	RSP=`curl -s --insecure -o /dev/null -w "%{http_code}" https://localhost:8080/idem/count`
+
+	if [ "X$RSP" != "X000" ]; then
+		echo "Expected connection refused while draining, got: [$RSP]"
+		go_out 77
+	fi
+
+	wait $CPID
+	RSP=`cat log/drain.out`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"T_LONG_FLD\":"* ]]; then
+		echo "Expected in-flight request completed at shutdown, got: [$RSP]"
+		go_out 78
+	fi
+
+	# process exits after drain
+	wait $RPID
+} >> $LOGFILE 2>&1
+
 unset NDRX_CCTAG
-kill -2 $RPID
 sleep 10
 
 # Start the non ssl version
@@ -1854,6 +1971,1387 @@ http://localhost:8080/header/cookies`
 		go_out 4
 	fi
 done
+
+###############################################################################
+echo "Method bound routes"
+###############################################################################
+{
+for i in {1..100}
+do
+
+	# GET goes to REGEXP (returns request buffer)
+	RSP=`curl -s -H "Content-Type: application/json" -X GET -d \
+"{\"T_STRING_FLD\":\"HELLO\"}" \
+http://localhost:8080/method/route`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"HELLO\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid GET response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 79
+	fi
+
+	# POST goes to FAILSV1
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":\"HELLO\"}" \
+http://localhost:8080/method/route`
+
+	RSP_EXPECTED="\"error_code\":11"
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"$RSP_EXPECTED"* ]]; then
+		echo "Invalid POST response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 80
+	fi
+
+	# DELETE is not configured
+	RSP=`curl -s -i -X DELETE http://localhost:8080/method/route`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"405 Method Not Allowed"* ]]; then
+		echo "Expected 405 for DELETE, got: [$RSP]"
+		go_out 81
+	fi
+
+	if [[ "$RSP" != *"Allow: GET, POST, PUT"* ]]; then
+		echo "Expected Allow header for DELETE, got: [$RSP]"
+		go_out 82
+	fi
+
+	# regexp route, method bound
+	RSP=`curl -s -i -X POST -d "{}" http://localhost:8080/method/regexp/test`
+
+	echo "Response: [$RSP]"
+
+	if [[ "$RSP" != *"Allow: GET"* ]]; then
+		echo "Expected 405/Allow GET for regexp route, got: [$RSP]"
+		go_out 83
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "URL templates and path parameters"
+###############################################################################
+{
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d "{}" \
+http://localhost:8080/path/abc/item/42`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"abc\",\"T_STRING_2_FLD\":\"42\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid template response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 84
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"string\":\"X\"}" http://localhost:8080/pathjson/7`
+
+	RSP_EXPECTED="{\"id\":\"7\",\"string\":\"X\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid JSON template response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 85
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d "{}" \
+http://localhost:8080/pathrex/123`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"123\",\"T_STRING_3_FLD\":\"\/pathrex\/123\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid regexp group response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 86
+	fi
+
+	# segment must not cross the slash
+	RSP=`curl -s -X POST -d "{}" http://localhost:8080/path/a/b/item/42`
+
+	if [ "X$RSP" != "X404 page not found" ]; then
+		echo "Expected 404 for invalid template path, got: [$RSP]"
+		go_out 87
+	fi
+done
+
+# path parameter field sent by client is replaced
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+-d "{\"T_STRING_2_FLD\":[\"X\",\"Y\"]}" http://localhost:8080/path/abc/item/42`
+
+RSP_EXPECTED="{\"T_STRING_FLD\":\"abc\",\"T_STRING_2_FLD\":\"42\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+	echo "Expected path parameter to replace client value, got: [$RSP], expected: [$RSP_EXPECTED]"
+	go_out 88
+fi
+
+# URL template requires format setting
+RSP=`curl -s -X POST -d "{}" http://localhost:8080/pathexact/7`
+
+if [ "X$RSP" != "X404 page not found" ]; then
+	echo "Expected 404 for template URL without format, got: [$RSP]"
+	go_out 89
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Multiple listeners"
+###############################################################################
+{
+for i in {1..100}
+do
+
+	# Route bound to admin listener
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"T_STRING_FLD\":\"ADMIN\"}" \
+http://localhost:8081/listener/admin`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"ADMIN\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid admin listener response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 90
+	fi
+
+	# Not visible on default listener
+	RSP=`curl -s -X POST -d "{}" http://localhost:8080/listener/admin`
+
+	if [ "X$RSP" != "X404 page not found" ]; then
+		echo "Expected 404 for admin route on default listener, got: [$RSP]"
+		go_out 91
+	fi
+
+	# Route bound to default listener, not visible on admin
+	RSP=`curl -s -X POST -d "{}" http://localhost:8081/listener/default`
+
+	if [ "X$RSP" != "X404 page not found" ]; then
+		echo "Expected 404 for default route on admin listener, got: [$RSP]"
+		go_out 92
+	fi
+
+	# Unbound routes are served on all listeners
+	RSP=`curl -s -H "Content-Type: application/json" -X GET -d \
+"{\"T_STRING_FLD\":\"HELLO\"}" \
+http://localhost:8081/method/route`
+
+	RSP_EXPECTED="{\"T_STRING_FLD\":\"HELLO\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid unbound route response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 93
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Built-in authentication"
+###############################################################################
+{
+JWT_OK="eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCIsImtpZCI6InRlc3QxIn0.\
+eyJzdWIiOiJjbGllbnQxIiwiYXVkIjoicmVzdGluLXRlc3QiLCJleHAiOjQxMDI0NDQ4MDB9.\
+kusacFoXK2HjNesiC8r6xj9Ob2V0wG0Pv-QyzLETx14"
+JWT_AUD="eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCIsImtpZCI6InRlc3QxIn0.\
+eyJzdWIiOiJjbGllbnQxIiwiYXVkIjoib3RoZXIiLCJleHAiOjQxMDI0NDQ4MDB9.\
+ku8q_PbhMq_rFia-0iYRlul2mYjBP94hbyTqGQEQkIo"
+JWT_EXP="eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCIsImtpZCI6InRlc3QxIn0.\
+eyJzdWIiOiJjbGllbnQxIiwiYXVkIjoicmVzdGluLXRlc3QiLCJleHAiOjE1MDAwMDAwMDB9.\
+uwmDD8p4S8V_tvh-xI5vCDpJWLi8-NMMmOJm88WraXc"
+
+for i in {1..100}
+do
+
+	RSP=`curl -s -u user1:secret123 -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"X\"}" http://localhost:8080/auth/basic`
+
+	RSP_EXPECTED="{\"Auth\":{\"User\":\"user1\"},\"string\":\"X\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid basic auth response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 94
+	fi
+
+	# Wrong password
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -u user1:bad -X POST -d "{}" \
+http://localhost:8080/auth/basic`
+
+	if [ "X$RSP" != "X401" ]; then
+		echo "Expected 401 for bad password, got: [$RSP]"
+		go_out 95
+	fi
+
+	# Valid user, but not allowed
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -u user2:secret123 -X POST -d "{}" \
+http://localhost:8080/auth/basic`
+
+	if [ "X$RSP" != "X403" ]; then
+		echo "Expected 403 for not allowed user, got: [$RSP]"
+		go_out 96
+	fi
+
+	RSP=`curl -s -H "X-API-Key: key-0001-test" -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"X\"}" http://localhost:8080/auth/apikey`
+
+	RSP_EXPECTED="{\"Auth\":{\"User\":\"client1\"},\"string\":\"X\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid API key response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 97
+	fi
+
+	RSP=`curl -s -H "X-API-Key: key-0002-test" -X POST -d "{}" \
+http://localhost:8080/auth/apikey`
+
+	RSP_EXPECTED="{\"error_code\":8,\"error_message\":\"Invalid API key\"}"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid bad API key response, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 98
+	fi
+
+	RSP=`curl -s -H "Authorization: Bearer $JWT_OK" -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"X\"}" http://localhost:8080/auth/jwt`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"User\":\"client1\""* || "X$RSP" != *"\"aud\":\"restin-test\""* ]]; then
+		echo "Invalid JWT response, got: [$RSP]"
+		go_out 99
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $JWT_AUD" \
+-X POST -d "{}" http://localhost:8080/auth/jwt`
+
+	if [ "X$RSP" != "X403" ]; then
+		echo "Expected 403 for JWT audience mismatch, got: [$RSP]"
+		go_out 100
+	fi
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $JWT_EXP" \
+-X POST -d "{}" http://localhost:8080/auth/jwt`
+
+	if [ "X$RSP" != "X401" ]; then
+		echo "Expected 401 for expired JWT, got: [$RSP]"
+		go_out 101
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Forged identity fields"
+###############################################################################
+{
+RSP=`curl -s -u user1:secret123 -H "Content-Type: application/json" -X POST \
+	-d '{"EX_IF_AUTHUSER":["admin","root"],"EX_IF_AUTHCLAIMS":"{\"role\":\"admin\"}","EX_IF_CERTSUBJ":"CN=admin"}' \
+	http://localhost:8080/auth/basic/ubf`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"EX_IF_AUTHUSER\":\"user1\""* || "X$RSP" == *"admin"* ||
+	"X$RSP" == *"root"* || "X$RSP" == *"EX_IF_AUTHCLAIMS"* ||
+	"X$RSP" == *"EX_IF_CERTSUBJ"* ]]; then
+	echo "Expected client sent identity fields replaced, got: [$RSP]"
+	go_out 102
+fi
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"Auth":{"User":"admin"},"ClientCert":{"Subject":"CN=admin"},"string":"X"}' \
+	http://localhost:8080/limit/body`
+
+RSP_EXPECTED="{\"string\":\"X\",\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+	echo "Expected client sent identity keys removed, got: [$RSP], expected: [$RSP_EXPECTED]"
+	go_out 103
+fi
+
+# keys written with JSON escapes are removed too
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"ClientCer\u0074":{"Subject":"CN=admin"},"string":"X"}' \
+	http://localhost:8080/limit/body`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+	echo "Expected escaped ClientCert key removed, got: [$RSP], expected: [$RSP_EXPECTED]"
+	go_out 104
+fi
+
+# principal cannot be forged by escaped key, when request has no credentials
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"Aut\u0068":{"User":"admin"},"string":"X"}' \
+	http://localhost:8080/limit/body`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+	echo "Expected escaped Auth key removed, got: [$RSP], expected: [$RSP_EXPECTED]"
+	go_out 105
+fi
+
+# nor if it has, principal of the credentials is passed
+RSP=`curl -s -u user1:secret123 -H "Content-Type: application/json" -X POST \
+	-d '{"Aut\u0068":{"User":"admin"},"string":"X"}' \
+	http://localhost:8080/auth/basic`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"User\":\"user1\""* || "X$RSP" == *"admin"* ]]; then
+	echo "Expected escaped Auth key replaced by principal, got: [$RSP]"
+	go_out 106
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Route rate limit and concurrency cap"
+###############################################################################
+{
+for i in {1..10}
+do
+	# burst of 2 per client, then limited
+	for j in 1 2
+	do
+		RSP=`curl -s -H "X-Client: C$i" -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":\"X\"}" http://localhost:8080/limit/rate`
+
+		RSP_EXPECTED="{\"T_STRING_FLD\":\"X\",\
+\"error_code\":0,\"error_message\":\"SUCCEED\"}"
+
+		echo "Response: [$RSP]"
+
+		if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+			echo "Invalid rate limit response, got: [$RSP], expected: [$RSP_EXPECTED]"
+			go_out 107
+		fi
+	done
+
+	RSP=`curl -s -i -H "X-Client: C$i" -X POST -d "{}" http://localhost:8080/limit/rate`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"429 Too Many Requests"* || "X$RSP" != *"Retry-After: 5"* ||
+		"X$RSP" != *"{\"error_code\":5,\"error_message\":\"Rate limit exceeded\"}"* ]]; then
+		echo "Expected 429 with Retry-After, got: [$RSP]"
+		go_out 108
+	fi
+done
+
+# one call in progress, second is rejected
+curl -s -X POST -d "{}" http://localhost:8080/limit/inflight &
+sleep 1
+
+RSP=`curl -s -i -X POST -d "{}" http://localhost:8080/limit/inflight`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"503 Service Unavailable"* || "X$RSP" != *"Retry-After: 1"* ]]; then
+	echo "Expected 503 with Retry-After, got: [$RSP]"
+	go_out 109
+fi
+
+wait
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Context pool status"
+###############################################################################
+{
+for i in {1..100}
+do
+
+	RSP=`curl -s http://localhost:8081/pool/status`
+
+	RSP_EXPECTED="{\"workers\":10,\"free\":10,\"waiting\":0}"
+
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid pool status, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 110
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Metrics"
+###############################################################################
+{
+# counters are checked by difference, earlier tests call the same routes
+METRIC_POST="restin_requests_total{route=\"/method/route\",method=\"POST\",code=\"200\",atmi_error=\"11\"}"
+METRIC_GET="restin_request_duration_seconds_count{route=\"/method/route\",method=\"GET\"}"
+
+RSP=`curl -s http://localhost:8081/metrics`
+POST_BEFORE=`echo "$RSP" | grep -F "$METRIC_POST " | cut -d' ' -f2`
+GET_BEFORE=`echo "$RSP" | grep -F "$METRIC_GET " | cut -d' ' -f2`
+
+for i in {1..10}
+do
+	curl -s -X POST -d "{}" http://localhost:8080/method/route > /dev/null
+done
+
+curl -s -X GET http://localhost:8080/method/route > /dev/null
+
+RSP=`curl -s http://localhost:8081/metrics`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"$METRIC_POST $((${POST_BEFORE:-0} + 10))"* ]]; then
+	echo "Missing request counter in metrics: [$RSP]"
+	go_out 111
+fi
+
+if [[ "X$RSP" != *"restin_request_duration_seconds_count{route=\"/method/route\",method=\"POST\"}"* ]]; then
+	echo "Missing latency histogram in metrics: [$RSP]"
+	go_out 112
+fi
+
+# GET route of the same URL is counted separately
+if [[ "X$RSP" != *"$METRIC_GET $((${GET_BEFORE:-0} + 1))"* ]]; then
+	echo "Missing metrics of GET route: [$RSP]"
+	go_out 113
+fi
+
+if [[ "X$RSP" != *"restin_pool_workers 10"* ]]; then
+	echo "Missing pool metrics: [$RSP]"
+	go_out 114
+fi
+
+# not served on default listener
+RSP=`curl -s http://localhost:8080/metrics`
+
+if [ "X$RSP" != "X404 page not found" ]; then
+	echo "Expected 404 for metrics on default listener, got: [$RSP]"
+	go_out 115
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "OpenAPI document"
+###############################################################################
+{
+RSP=`curl -s http://localhost:8081/openapi.json`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"openapi\": \"3.0.3\""* ]]; then
+	echo "Invalid OpenAPI document: [$RSP]"
+	go_out 116
+fi
+
+# errfmt_json_* key names of /svc1
+if [[ "X$RSP" != *"\"error_code1\""* || "X$RSP" != *"\"error_message1\""* ]]; then
+	echo "Missing JSON error fields in OpenAPI document: [$RSP]"
+	go_out 117
+fi
+
+# VIEW layouts from view tables
+if [[ "X$RSP" != *"\"REQUEST1\": {"* || "X$RSP" != *"\"tstring1\""* || \
+	"X$RSP" != *"\"RSPV\": {"* ]]; then
+	echo "Missing VIEW schemas in OpenAPI document: [$RSP]"
+	go_out 118
+fi
+
+# template route with path parameter
+if [[ "X$RSP" != *"\"in\": \"path\""* ]]; then
+	echo "Missing path parameters in OpenAPI document: [$RSP]"
+	go_out 119
+fi
+
+# routes without methods are documented with common methods
+if [[ "X$RSP" != *"\"description\": \"Route accepts any HTTP method\""* || \
+	"X$RSP" != *"\"put\": {"* ]]; then
+	echo "Missing any method operations in OpenAPI document: [$RSP]"
+	go_out 120
+fi
+
+# regexp routes are listed as omitted
+if [[ "X$RSP" != *"\"x-omitted-routes\": ["* || \
+	"X$RSP" != *"\"/regexp/empty\""* ]]; then
+	echo "Missing omitted regexp routes in OpenAPI document: [$RSP]"
+	go_out 121
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "CORS preflight and actual request"
+###############################################################################
+{
+HDRS=`curl -s -D - -o /dev/null -X OPTIONS -H "Origin: https://app.example.com" \
+-H "Access-Control-Request-Method: POST" http://localhost:8080/cors/echo | tr -d '\r'`
+
+echo "Headers: [$HDRS]"
+
+if [[ "X$HDRS" != *"HTTP/1.1 204"* || \
+	"X$HDRS" != *"Access-Control-Allow-Origin: https://app.example.com"* || \
+	"X$HDRS" != *"Access-Control-Allow-Methods: POST"* || \
+	"X$HDRS" != *"Access-Control-Allow-Headers: Content-Type"* || \
+	"X$HDRS" != *"Access-Control-Allow-Credentials: true"* || \
+	"X$HDRS" != *"Access-Control-Max-Age: 600"* ]]; then
+	echo "Invalid CORS preflight response: [$HDRS]"
+	go_out 122
+fi
+
+# origin not matching wildcard
+HDRS=`curl -s -D - -o /dev/null -X OPTIONS -H "Origin: https://example.org" \
+-H "Access-Control-Request-Method: POST" http://localhost:8080/cors/echo | tr -d '\r'`
+
+echo "Headers: [$HDRS]"
+
+if [[ "X$HDRS" != *"HTTP/1.1 403"* || "X$HDRS" == *"Access-Control-Allow-Origin"* ]]; then
+	echo "Expected 403 for not allowed origin: [$HDRS]"
+	go_out 123
+fi
+
+HDRS=`curl -s -D - -H "Origin: https://app.example.com" -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":\"CORS\"}" http://localhost:8080/cors/echo | tr -d '\r'`
+
+echo "Response: [$HDRS]"
+
+if [[ "X$HDRS" != *"Access-Control-Allow-Origin: https://app.example.com"* || \
+	"X$HDRS" != *"\"T_STRING_FLD\":\"CORS\""* ]]; then
+	echo "Invalid CORS response: [$HDRS]"
+	go_out 124
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Response compression and compressed request body"
+###############################################################################
+{
+HDRS=`curl -s -D - -o compressed.out -H "Accept-Encoding: gzip" -H "Content-Type: application/json" \
+-X POST -d "{\"string\":\"COMPRESSED RESPONSE\"}" http://localhost:8080/compress/echo | tr -d '\r'`
+
+RSP=`gunzip -c compressed.out`
+rm -f compressed.out
+
+echo "Headers: [$HDRS] Response: [$RSP]"
+
+if [[ "X$HDRS" != *"Content-Encoding: gzip"* || \
+	"X$RSP" != *"\"string\":\"COMPRESSED RESPONSE\""* ]]; then
+	echo "Invalid compressed response: [$HDRS] [$RSP]"
+	go_out 125
+fi
+
+RSP=`echo -n "{\"string\":\"GZIP REQUEST\"}" | gzip | curl -s -H "Content-Encoding: gzip" \
+-H "Content-Type: application/json" -X POST --data-binary @- http://localhost:8080/compress/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"string\":\"GZIP REQUEST\""* ]]; then
+	echo "Invalid response to gzip request: [$RSP]"
+	go_out 126
+fi
+
+# over max_inflate_size
+RSP=`head -c 5000 /dev/zero | gzip | curl -s -w "%{http_code}" -o /dev/null -H "Content-Encoding: gzip" \
+-H "Content-Type: application/json" -X POST --data-binary @- http://localhost:8080/compress/echo`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X413" ]; then
+	echo "Expected 413 for decompressed body over limit, got: [$RSP]"
+	go_out 127
+fi
+
+# unsupported encoding is not echoed in the error
+RSP=`curl -s -w " %{http_code}" -H 'Content-Encoding: x","error_code":0,"a":"' \
+-H "Content-Type: application/json" -X POST -d "{}" http://localhost:8080/compress/echo`
+
+RSP_EXPECTED="{\"error_code\":4,\"error_message\":\"Unsupported Content-Encoding\"} 415"
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+	echo "Invalid unsupported encoding response, got: [$RSP], expected: [$RSP_EXPECTED]"
+	go_out 128
+fi
+
+# max_body_size applies to inflated body, small compressed body is rejected
+RSP=`echo -n "{\"string\":\"$(head -c 200 /dev/zero | tr '\0' 'X')\"}" | gzip | \
+	curl -s -o /dev/null -w "%{http_code}" -H "Content-Encoding: gzip" \
+	-H "Content-Type: application/json" -X POST --data-binary @- \
+	http://localhost:8080/limit/body`
+
+if [ "X$RSP" != "X413" ]; then
+	echo "Expected 413 for inflated body over max_body_size, got: [$RSP]"
+	go_out 129
+fi
+
+# compressed uploads are not buffered, but rejected
+echo -n "DATA" > gz_upload.blob
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Encoding: gzip" \
+	-F "files[]=@gz_upload.blob" http://localhost:8080/limit/upload`
+rm -f gz_upload.blob
+
+if [ "X$RSP" != "X415" ]; then
+	echo "Expected 415 for compressed upload, got: [$RSP]"
+	go_out 130
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Request body size limits"
+###############################################################################
+{
+BODY="{\"string\":\"`head -c 200 /dev/zero | tr '\0' 'X'`\"}"
+
+# Content-Length known, rejected before read
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" -X POST -d "$BODY" \
+http://localhost:8080/limit/body`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X{\"error_code\":4,\"error_message\":\"Request body too large\"} 413" ]; then
+	echo "Expected 413 for body over max_body_size, got: [$RSP]"
+	go_out 131
+fi
+
+# chunked, limited on read
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" -H "Transfer-Encoding: chunked" \
+-X POST -d "$BODY" http://localhost:8080/limit/body`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X{\"error_code\":4,\"error_message\":\"Request body too large\"} 413" ]; then
+	echo "Expected 413 for chunked body over max_body_size, got: [$RSP]"
+	go_out 132
+fi
+
+# file over max_file_size, temp files removed
+head -c 1000 /dev/zero > big_upload.blob
+FILES_BEFORE=`ls tmp 2>/dev/null | wc -l`
+
+RSP=`curl -s -w "%{http_code}" -o /dev/null -F "files[]=@big_upload.blob" http://localhost:8080/limit/upload`
+FILES_AFTER=`ls tmp 2>/dev/null | wc -l`
+rm -f big_upload.blob
+
+echo "Response: [$RSP] files before: $FILES_BEFORE after: $FILES_AFTER"
+
+if [ "X$RSP" != "X413" ] || [ $FILES_BEFORE -ne $FILES_AFTER ]; then
+	echo "Expected 413 and no temp files for upload over max_file_size: [$RSP]"
+	go_out 133
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "h2c listener and header read timeout"
+###############################################################################
+{
+RSP=`curl -s --http2-prior-knowledge -w " %{http_version}" -H "Content-Type: application/json" \
+-X POST -d "{\"T_STRING_FLD\":\"H2C\"}" http://localhost:8081/listener/admin`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"T_STRING_FLD\":\"H2C\""*" 2" ]]; then
+	echo "Expected h2c response on admin listener, got: [$RSP]"
+	go_out 134
+fi
+
+# default listener has no h2c
+RSP=`curl -s --http2-prior-knowledge -o /dev/null -w "%{http_version}" \
+http://localhost:8080/pool/status`
+
+if [ "X$RSP" == "X2" ]; then
+	echo "Unexpected h2c on default listener"
+	go_out 135
+fi
+
+# incomplete headers, connection must be closed after read_header_timeout
+START=$SECONDS
+exec 3<>/dev/tcp/localhost/8080
+printf "GET /pool/status HTTP/1.1\r\nHost: localhost\r\n" >&3
+timeout 20 cat <&3 >/dev/null
+exec 3<&-
+ELAPSED=$((SECONDS - START))
+
+echo "Slow client connection closed after $ELAPSED sec"
+
+if [ $ELAPSED -ge 15 ]; then
+	echo "Slow client not disconnected by read_header_timeout"
+	go_out 136
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "WebSocket messages and push"
+###############################################################################
+{
+RSP=`wscl localhost:8080 /ws/json "{\"string\":\"WS\"}" 1`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"ConnId\":"* || "X$RSP" != *"\"string\":\"WS\""* || \
+	"X$RSP" != *"\"error_code\":0"* ]]; then
+	echo "Invalid WebSocket json response: [$RSP]"
+	go_out 137
+fi
+
+# reply and event pushed by the service to the same connection
+RSP=`wscl localhost:8080 /ws/push "{\"T_STRING_FLD\":\"HELLO\"}" 2`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"T_STRING_FLD\":\"HELLO\""* || \
+	"X$RSP" != *"\"T_STRING_FLD\":\"PUSHED\""* ]]; then
+	echo "Expected reply and push message on WebSocket: [$RSP]"
+	go_out 138
+fi
+
+# plain request is rejected
+RSP=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/ws/json`
+
+if [ "X$RSP" != "X426" ]; then
+	echo "Expected 426 for non upgrade request, got: [$RSP]"
+	go_out 139
+fi
+
+# connection id sent by client is replaced
+RSP=`wscl localhost:8080 /ws/json "{\"ConnId\":999999,\"string\":\"WS\"}" 1`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"ConnId\":"* || "X$RSP" == *"999999"* ]]; then
+	echo "Expected client sent ConnId replaced: [$RSP]"
+	go_out 140
+fi
+
+# key written with JSON escape is the same key, replaced too
+RSP=`wscl localhost:8080 /ws/json '{"ConnI\u0064":999999,"string":"WS"}' 1`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"ConnId\":"* || "X$RSP" == *"999999"* ]]; then
+	echo "Expected escaped ConnId key replaced: [$RSP]"
+	go_out 141
+fi
+
+# cross-origin upgrade is rejected, if no cors_origins are configured
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Origin: http://evil.example.com" \
+	-H "Upgrade: websocket" -H "Connection: Upgrade" -H "Sec-WebSocket-Version: 13" \
+	-H "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==" http://localhost:8080/ws/json`
+
+if [ "X$RSP" != "X403" ]; then
+	echo "Expected 403 for cross-origin upgrade, got: [$RSP]"
+	go_out 142
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Server-Sent Events"
+###############################################################################
+{
+rm -f sse.out 2>/dev/null
+curl -s -N --max-time 4 http://localhost:8080/sse/events > sse.out &
+SSEPID=$!
+sleep 1
+
+for EVT in EVT1 SKIP EVT2; do
+	curl -s -H "Content-Type: application/json" -X POST \
+		-d "{\"T_STRING_FLD\":\"$EVT\"}" http://localhost:8080/sse/post
+done
+
+wait $SSEPID
+
+RSP=`cat sse.out`
+echo "Stream: [$RSP]"
+
+if [[ "X$RSP" != *"event: status"* || \
+	"X$RSP" != *"\"T_STRING_FLD\":\"EVT1\""* || \
+	"X$RSP" != *"\"T_STRING_FLD\":\"EVT2\""* ]]; then
+	echo "Expected EVT1 and EVT2 events in stream: [$RSP]"
+	go_out 143
+fi
+
+# filtered out by sse_filter
+if [[ "X$RSP" == *"SKIP"* ]]; then
+	echo "Filtered event in stream: [$RSP]"
+	go_out 144
+fi
+
+CT=`curl -s -o /dev/null --max-time 1 -w "%{content_type}" http://localhost:8080/sse/events`
+
+if [ "X$CT" != "Xtext/event-stream" ]; then
+	echo "Invalid SSE content type: [$CT]"
+	go_out 145
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Conversational download"
+###############################################################################
+{
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"OK"}' http://localhost:8080/conv/download`
+
+EXP=`printf "CHUNK1\nCHUNK2\nCHUNK3\nEND"`
+
+if [ "X$RSP" != "X$EXP" ]; then
+	echo "Invalid conversational download: [$RSP]"
+	go_out 146
+fi
+
+# failure before data is answered as error
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"FAIL"}' http://localhost:8080/conv/download`
+
+if [[ "X$RSP" != *"\"error_code\":11"* ]]; then
+	echo "Expected TPESVCFAIL for failed download: [$RSP]"
+	go_out 147
+fi
+
+# failure after data aborts the transfer
+curl -s -o /dev/null -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"FAILMID"}' http://localhost:8080/conv/download
+RET=$?
+
+if [ $RET -eq 0 ]; then
+	echo "Expected incomplete transfer for failed download"
+	go_out 148
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Conversational upload and temp file cleanup"
+###############################################################################
+{
+head -c 2500 /dev/zero > conv_upload1.blob
+head -c 10 /dev/zero > conv_upload2.blob
+
+RSP=`curl -s -F "files[]=@conv_upload1.blob" -F "doc=@conv_upload2.blob" \
+	http://localhost:8080/conv/upload`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "Xfiles[]:conv_upload1.blob:2500;doc:conv_upload2.blob:10" ]; then
+	echo "Invalid conversational upload response: [$RSP]"
+	go_out 149
+fi
+
+# file over max_file_size
+head -c 100001 /dev/zero > conv_upload1.blob
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@conv_upload1.blob" \
+	http://localhost:8080/conv/upload`
+rm -f conv_upload1.blob conv_upload2.blob
+
+if [ "X$RSP" != "X413" ]; then
+	echo "Expected 413 for conversational upload over max_file_size: [$RSP]"
+	go_out 150
+fi
+
+FILES_BEFORE=`ls tmp 2>/dev/null | wc -l`
+curl -s -o /dev/null -F "files[]=@../binary.test.response" \
+	http://localhost:8080/upload/noent
+FILES_AFTER=`ls tmp 2>/dev/null | wc -l`
+
+if [ $FILES_BEFORE -ne $FILES_AFTER ]; then
+	echo "Temp files left after failed call: $FILES_BEFORE vs $FILES_AFTER"
+	go_out 151
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Idempotency-Key"
+###############################################################################
+{
+KEY="key-$$-$RANDOM"
+
+RSP1=`curl -s -H "Idempotency-Key: $KEY" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"PAY"}' http://localhost:8080/idem/count`
+RSP2=`curl -s -i -H "Idempotency-Key: $KEY" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"PAY"}' http://localhost:8080/idem/count`
+
+echo "Response: [$RSP1] repeated: [$RSP2]"
+
+if [[ "X$RSP1" != *"\"T_LONG_FLD\":"* || "X$RSP2" != *"$RSP1"* || \
+	"X$RSP2" != *"Idempotent-Replayed: true"* ]]; then
+	echo "Expected stored response for repeated request"
+	go_out 152
+fi
+
+# other key calls the service again
+RSP3=`curl -s -H "Idempotency-Key: $KEY-2" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"PAY"}' http://localhost:8080/idem/count`
+
+if [ "X$RSP3" == "X$RSP1" ]; then
+	echo "Expected new response for other key: [$RSP3]"
+	go_out 153
+fi
+
+# same key, other request
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Idempotency-Key: $KEY" \
+	-H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"OTHER"}' \
+	http://localhost:8080/idem/count`
+
+if [ "X$RSP" != "X422" ]; then
+	echo "Expected 422 for key reused with other body, got: [$RSP]"
+	go_out 154
+fi
+
+# concurrent duplicate
+curl -s -o /dev/null -H "Idempotency-Key: $KEY-slow" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"SLOW"}' http://localhost:8080/idem/count &
+SLOWPID=$!
+sleep 1
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "Idempotency-Key: $KEY-slow" \
+	-H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"SLOW"}' \
+	http://localhost:8080/idem/count`
+wait $SLOWPID
+
+if [ "X$RSP" != "X409" ]; then
+	echo "Expected 409 for concurrent duplicate, got: [$RSP]"
+	go_out 155
+fi
+
+if ! grep -q "$KEY" log/idempotency.db; then
+	echo "Stored response not persisted"
+	go_out 156
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Response cache"
+###############################################################################
+{
+RSP1=`curl -s "http://localhost:8080/cache/count?id=1&other=a"`
+RSP2=`curl -s -D log/cache_hdr.out "http://localhost:8080/cache/count?other=b&id=1"`
+
+echo "Response: [$RSP1] repeated: [$RSP2]"
+
+if [[ "X$RSP1" != "Xcount="* || "X$RSP2" != "X$RSP1" ]]; then
+	echo "Expected cached response for repeated request"
+	go_out 157
+fi
+
+ETAG=`grep -i "^ETag:" log/cache_hdr.out | cut -d' ' -f2 | tr -d '\r'`
+
+if [ "X$ETAG" == "X" ] || ! grep -qi "^Age:" log/cache_hdr.out; then
+	echo "Expected ETag and Age headers for cached response"
+	go_out 158
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -H "If-None-Match: $ETAG" \
+	"http://localhost:8080/cache/count?id=1"`
+
+if [ "X$RSP" != "X304" ]; then
+	echo "Expected 304 for If-None-Match [$ETAG], got: [$RSP]"
+	go_out 159
+fi
+
+# other key value calls the service again
+RSP3=`curl -s "http://localhost:8080/cache/count?id=2"`
+
+if [[ "X$RSP3" != "Xcount="* || "X$RSP3" == "X$RSP1" ]]; then
+	echo "Expected new response for other id: [$RSP3]"
+	go_out 160
+fi
+
+# service forbids caching
+RSP1=`curl -s "http://localhost:8080/cache/count?id=3&nostore"`
+RSP2=`curl -s "http://localhost:8080/cache/count?id=3&nostore"`
+
+if [ "X$RSP1" == "X$RSP2" ]; then
+	echo "Expected no caching with Cache-Control: no-store [$RSP1]"
+	go_out 161
+fi
+
+# response setting cookie is not cached
+RSP1=`curl -s "http://localhost:8080/cache/count?id=4&cookie"`
+RSP2=`curl -s -D log/cache_hdr.out "http://localhost:8080/cache/count?id=4&cookie"`
+
+if [ "X$RSP1" == "X$RSP2" ] || ! grep -qi "^Set-Cookie: session=" log/cache_hdr.out; then
+	echo "Expected no caching of response with Set-Cookie [$RSP1] [$RSP2]"
+	go_out 162
+fi
+
+# responses are not shared between sessions
+RSP1=`curl -s -H "Cookie: session=A$$" "http://localhost:8080/cache/count?id=5"`
+RSP2=`curl -s -H "Cookie: session=B$$" "http://localhost:8080/cache/count?id=5"`
+RSP3=`curl -s -H "Cookie: session=A$$" "http://localhost:8080/cache/count?id=5"`
+
+echo "Response: session A [$RSP1] session B [$RSP2] session A [$RSP3]"
+
+if [[ "X$RSP1" != "Xcount="* || "X$RSP2" == "X$RSP1" || "X$RSP3" != "X$RSP1" ]]; then
+	echo "Expected responses cached per session cookie"
+	go_out 163
+fi
+
+# responses are not shared between principals
+RSP1=`curl -s -u user1:secret123 http://localhost:8080/cache/auth`
+RSP2=`curl -s -u user2:secret123 http://localhost:8080/cache/auth`
+RSP3=`curl -s -u user1:secret123 http://localhost:8080/cache/auth`
+
+echo "Response: user1 [$RSP1] user2 [$RSP2] user1 [$RSP3]"
+
+if [[ "X$RSP1" != "Xcount="* || "X$RSP2" == "X$RSP1" || "X$RSP3" != "X$RSP1" ]]; then
+	echo "Expected cached response per principal"
+	go_out 164
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Global transactions"
+###############################################################################
+{
+# commit on success
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/tx/call?id=TXOK$$"`
+
+echo "Response: [$RSP]"
+
+RSP=`curl -s "http://localhost:8080/tx/status?corrid=TXOK$$"`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"T_STRING_FLD\":\"TXOK$$\""* ]]; then
+	echo "Expected message committed by transaction, got: [$RSP]"
+	go_out 165
+fi
+
+# abort on service failure
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/tx/call?id=TXFAIL$$&fail"`
+
+if [ "X$RSP" == "X200" ]; then
+	echo "Expected failure of service call, got: [$RSP]"
+	go_out 166
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/tx/status?corrid=TXFAIL$$"`
+
+if [ "X$RSP" != "X202" ]; then
+	echo "Expected message rolled back on service failure, got: [$RSP]"
+	go_out 167
+fi
+
+# abort on filter rejection
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/tx/filter?id=TXFLT$$&fail"`
+
+if [ "X$RSP" == "X200" ]; then
+	echo "Expected filter rejection, got: [$RSP]"
+	go_out 168
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/tx/status?corrid=TXFLT$$"`
+
+if [ "X$RSP" != "X202" ]; then
+	echo "Expected message rolled back on filter rejection, got: [$RSP]"
+	go_out 169
+fi
+
+# heuristic outcomes cannot be provoked without faulty resource manager, thus
+# their distinct default statuses are checked in OpenAPI responses of the route
+RSP=`curl -s http://localhost:8081/openapi.json | sed -n '/"\/tx\/http": {/,/^    }/p'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"502\": {"* || "X$RSP" != *"\"409\": {"* ]]; then
+	echo "Expected 502 and 409 statuses for TPEHAZARD and TPEHEURISTIC, got: [$RSP]"
+	go_out 170
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Persistent queue async calls"
+###############################################################################
+{
+RSP=`curl -s -D log/queue_hdr.out -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"QMSG"}' http://localhost:8080/queue/submit`
+CORRID=`grep -i "^Queue-Corrid:" log/queue_hdr.out | cut -d' ' -f2 | tr -d '\r'`
+
+echo "Response: [$RSP] corrid: [$CORRID]"
+
+if [[ "X$CORRID" == "X" ]] || ! grep -qi "^Queue-Msgid:" log/queue_hdr.out; then
+	echo "Expected message and correlation ids of enqueued request"
+	go_out 171
+fi
+
+RSP=`curl -s "http://localhost:8080/queue/status?corrid=$CORRID"`
+
+if [[ "X$RSP" != *"QMSG"* ]]; then
+	echo "Expected enqueued message by correlation id, got: [$RSP]"
+	go_out 172
+fi
+
+# reply is kept until removed, repeated read gives the same message
+RSP=`curl -s "http://localhost:8080/queue/status?corrid=$CORRID"`
+
+if [[ "X$RSP" != *"QMSG"* ]]; then
+	echo "Expected message to be kept in queue, got: [$RSP]"
+	go_out 173
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X DELETE "http://localhost:8080/queue/status?corrid=$CORRID"`
+
+if [ "X$RSP" != "X204" ]; then
+	echo "Expected 204 for removed message, got: [$RSP]"
+	go_out 174
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X DELETE "http://localhost:8080/queue/status?corrid=$CORRID"`
+
+if [ "X$RSP" != "X404" ]; then
+	echo "Expected 404 for already removed message, got: [$RSP]"
+	go_out 175
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/queue/status?corrid=$CORRID"`
+
+if [ "X$RSP" != "X202" ]; then
+	echo "Expected 202 for message not available, got: [$RSP]"
+	go_out 176
+fi
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" "http://localhost:8080/queue/status"`
+
+if [ "X$RSP" != "X400" ]; then
+	echo "Expected 400 for missing correlation id, got: [$RSP]"
+	go_out 177
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Configuration reload"
+###############################################################################
+{
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST -d '{}' http://localhost:8080/reload/count`
+
+if [ "X$RSP" != "X404" ]; then
+	echo "Expected 404 for route not configured, got: [$RSP]"
+	go_out 178
+fi
+
+# add route and resize the pool
+conf_save
+sed -i 's|^\[@restin\]$|[@restin]\nworkers=5\n/reload/count={"svc":"IDEMCNT", "conv":"json2ubf", "errors":"json2ubf"}|' \
+	conf/restin.ini
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8081/admin/reload`
+
+if [ "X$RSP" != "X200" ]; then
+	echo "Expected 200 for reload, got: [$RSP]"
+	go_out 179
+fi
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/reload/count`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"T_LONG_FLD"* ]]; then
+	echo "Expected response of reloaded route, got: [$RSP]"
+	go_out 180
+fi
+
+RSP=`curl -s http://localhost:8081/pool/status`
+
+if [[ "X$RSP" != *"\"workers\":5,"* ]]; then
+	echo "Expected pool of 5 workers, got: [$RSP]"
+	go_out 181
+fi
+
+# invalid config is rejected, old routes are kept
+sed -i 's|^\[@restin\]$|[@restin]\n/reload/bad={"svc":"IDEMCNT", "conv":"nosuch"}|' \
+	conf/restin.ini
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8081/admin/reload`
+
+if [ "X$RSP" != "X500" ]; then
+	echo "Expected 500 for invalid config reload, got: [$RSP]"
+	go_out 182
+fi
+
+pkill -HUP -x restincl
+sleep 1
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/reload/count`
+
+if [[ "X$RSP" != *"T_LONG_FLD"* ]]; then
+	echo "Expected old routes kept after failed reload, got: [$RSP]"
+	go_out 183
+fi
+
+# original config
+conf_restore
+pkill -HUP -x restincl
+sleep 1
+
+RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST -d '{}' http://localhost:8080/reload/count`
+
+if [ "X$RSP" != "X404" ]; then
+	echo "Expected 404 for removed route, got: [$RSP]"
+	go_out 184
+fi
+
+RSP=`curl -s http://localhost:8081/pool/status`
+
+if [[ "X$RSP" != *"\"workers\":10,"* ]]; then
+	echo "Expected pool of 10 workers, got: [$RSP]"
+	go_out 185
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Invalid routes rejected by configuration reload"
+###############################################################################
+{
+# transaction route with async mode
+conf_save
+sed -i 's|^\[@restin\]$|[@restin]\n/tx/bad={"svc":"TXENQ", "conv":"ext", "transaction":true, "async":true}|' \
+	conf/restin.ini
+
+RSP=`curl -s -X POST http://localhost:8081/admin/reload`
+
+echo "Response: [$RSP]"
+
+conf_restore
+
+if [[ "X$RSP" != *"transaction not supported"* ]]; then
+	echo "Expected transaction route with async rejected, got: [$RSP]"
+	go_out 186
+fi
+
+# URL template with conversion not taking path parameters
+conf_save
+sed -i 's|^\[@restin\]$|[@restin]\n/pathtext/{id}={"svc":"REGEXP", "format":"t", "conv":"text"}|' \
+	conf/restin.ini
+
+RSP=`curl -s -X POST http://localhost:8081/admin/reload`
+
+echo "Response: [$RSP]"
+
+conf_restore
+
+if [[ "X$RSP" != *"path parameters not supported"* ]]; then
+	echo "Expected URL template with text conversion rejected, got: [$RSP]"
+	go_out 187
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Built-in end-points bound to admin_route listeners"
+###############################################################################
+{
+for URL in /admin/reload /pool/status /openapi.json; do
+
+	RSP=`curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8080$URL`
+
+	echo "Response: [$URL] [$RSP]"
+
+	if [ "X$RSP" != "X404" ]; then
+		echo "Expected built-in [$URL] not served on default listener, got: [$RSP]"
+		go_out 188
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "XML conversion"
+###############################################################################
+{
+RSP=`curl -s -D log/xml_hdr.out -H "Content-Type: application/xml" -X POST \
+	-d '<UBF><T_STRING_FLD>HELLO &amp; BYE</T_STRING_FLD><T_LONG_FLD>1</T_LONG_FLD><T_LONG_FLD>2</T_LONG_FLD></UBF>' \
+	http://localhost:8080/xml/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<T_STRING_FLD>HELLO &amp; BYE</T_STRING_FLD>"* ||
+	"X$RSP" != *"<T_LONG_FLD>2</T_LONG_FLD>"* ]]; then
+	echo "Expected fields and occurrences echoed, got: [$RSP]"
+	go_out 189
+fi
+
+if [[ "X$RSP" != *"<error_code>0</error_code><error_message>SUCCEED</error_message></UBF>"* ]] ||
+	! grep -qi "^Content-Type: application/xml" log/xml_hdr.out; then
+	echo "Expected success code in application/xml response, got: [$RSP]"
+	go_out 190
+fi
+
+RSP=`curl -s -H "Content-Type: application/xml" -X POST \
+	-d '<UBF><T_STRING_FLD>HELLO</T_STRING_FLD></UBF>' http://localhost:8080/xml/fail`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<error_code>11</error_code>"* ]]; then
+	echo "Expected TPESVCFAIL error code, got: [$RSP]"
+	go_out 191
+fi
+
+RSP=`curl -s -H "Content-Type: application/xml" -X POST \
+	-d '<UBF><NO_SUCH_FLD>1</NO_SUCH_FLD></UBF>' http://localhost:8080/xml/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<error_code>4</error_code>"* ]]; then
+	echo "Expected TPEINVAL error code for unknown field, got: [$RSP]"
+	go_out 192
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Problem details errors"
+###############################################################################
+{
+RSP=`curl -s -D log/problem_hdr.out -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"HELLO"}' http://localhost:8080/problem/fail`
+REQID=`grep -i "^X-Request-Id:" log/problem_hdr.out | cut -d' ' -f2 | tr -d '\r'`
+
+echo "Response: [$RSP] request id: [$REQID]"
+
+if ! grep -q "^HTTP/1.1 500" log/problem_hdr.out ||
+	! grep -qi "^Content-Type: application/problem+json" log/problem_hdr.out; then
+	echo "Expected 500 application/problem+json response"
+	go_out 193
+fi
+
+if [[ "X$RSP" != *"\"status\":500"* || "X$RSP" != *"\"atmi_code\":11"* ||
+	"X$RSP" != *"\"error_source\":\"S\""* || "X$REQID" == "X" ||
+	"X$RSP" != *"\"request_id\":\"$REQID\""* ]]; then
+	echo "Expected problem details with XATMI code, source and request id"
+	go_out 194
+fi
+
+RSP=`curl -s -w "%{http_code}" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"HELLO"}' http://localhost:8080/problem/echo`
+
+echo "Response: [$RSP]"
+
+if [ "X$RSP" != "X{\"T_STRING_FLD\":\"HELLO\"}200" ]; then
+	echo "Expected response as is on success, got: [$RSP]"
+	go_out 195
+fi
+} >> $LOGFILE 2>&1
+
 # go_out alreay doing stop
 #xadmin stop -c -y
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+var cacheCalls int64 //Number of CACHECNT calls
+
+//Count the calls, for response cache tests. Query parameter "nostore"
+//makes the service to forbid the caching by Cache-Control header,
+//"cookie" makes the service to set the session cookie
+//@param ac ATMI Context
+//@param svc Service call information
+func CACHECNT(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+	}()
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (CACHECNT):")
+
+	occs, _ := ub.BOccur(u.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+		switch nam, _ := ub.BGetString(u.EX_IF_REQQUERYN, i); nam {
+		case "nostore":
+			ub.BAdd(u.EX_IF_RSPHN, "Cache-Control")
+			ub.BAdd(u.EX_IF_RSPHV, "no-store")
+		case "cookie":
+			ub.BAdd(u.EX_IF_RSPCN, "session")
+			ub.BAdd(u.EX_IF_RSPCV, fmt.Sprintf("sess%d", cacheCalls))
+		}
+	}
+
+	cacheCalls++
+	ub.BAdd(u.EX_IF_RSPHN, "Content-Type")
+	ub.BAdd(u.EX_IF_RSPHV, "text/plain")
+	ub.BChg(u.EX_IF_RSPDATA, 0, []byte(fmt.Sprintf("count=%d", cacheCalls)))
+
+	return
+}
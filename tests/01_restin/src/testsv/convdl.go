@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Conversational download service, sends chunks to restincl with tpsend
+//and returns the last one. T_STRING_FLD selects the failure mode:
+//FAIL - fail before data sent, FAILMID - fail after first chunk
+//@param ac ATMI Context
+//@param svc Service call information
+func CONVDL(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ac.TpLogInfo("Got UBF: [%v]", ub)
+
+	mode, _ := ub.BGetString(u.T_STRING_FLD, 0)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	if "FAIL" == mode {
+		ret = FAIL
+		return
+	}
+
+	for i := 1; i <= 3; i++ {
+		chunk, err := ac.NewCarray([]byte(fmt.Sprintf("CHUNK%d\n", i)))
+
+		if nil != err {
+			ac.TpLogError("Failed to alloc chunk: %s", err.Message())
+			ret = FAIL
+			return
+		}
+
+		if _, err := ac.TpSend(svc.Cd, chunk, 0); nil != err {
+			ac.TpLogError("Failed to send chunk %d: %s", i, err.Message())
+			ret = FAIL
+			return
+		}
+
+		if "FAILMID" == mode {
+			ret = FAIL
+			return
+		}
+	}
+
+	//Last chunk with the return
+	ub.BChg(u.EX_IF_RSPDATA, 0, []byte("END\n"))
+
+	return
+}
+
+//Conversational upload service, receives the streamed parts and returns
+//summary "<form>:<file>:<size>;..." in EX_IF_RSPDATA
+//@param ac ATMI Context
+//@param svc Service call information
+func CONVUP(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+	var parts []string
+	var sizes []int
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ac.TpLogInfo("Got UBF: [%v]", ub)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	chunk, err := ac.NewUBF(65536)
+
+	if nil != err {
+		ac.TpLogError("Failed to alloc UBF: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	for {
+		done := false
+
+		if revent, err := ac.TpRecv(svc.Cd, chunk, 0); nil != err {
+			if atmi.TPEEVENT == err.Code() && atmi.TPEV_SENDONLY == revent {
+				done = true
+			} else {
+				ac.TpLogError("Failed to receive: %s (event %d)",
+					err.Message(), revent)
+				ret = FAIL
+				return
+			}
+		}
+
+		if chunk.BPres(u.EX_IF_REQFILEPART, 0) {
+			part, _ := chunk.BGetInt(u.EX_IF_REQFILEPART, 0)
+			data, _ := chunk.BGetByteArr(u.EX_IF_REQDATA, 0)
+
+			if part == len(parts) {
+				form, _ := chunk.BGetString(u.EX_IF_REQFILEFORM, 0)
+				name, _ := chunk.BGetString(u.EX_IF_REQFILENAME, 0)
+				parts = append(parts, form+":"+name)
+				sizes = append(sizes, 0)
+			}
+
+			sizes[part] += len(data)
+		}
+
+		if done {
+			break
+		}
+	}
+
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%s:%d", parts[i], sizes[i])
+	}
+
+	ub.BChg(u.EX_IF_RSPDATA, 0, []byte(strings.Join(parts, ";")))
+
+	return
+}
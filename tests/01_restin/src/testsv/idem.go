@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+var idemCalls int64 //Number of IDEMCNT calls
+
+//Count the calls, for Idempotency-Key tests. T_STRING_FLD "SLOW" makes
+//the call to last 3 seconds
+//@param ac ATMI Context
+//@param svc Service call information
+func IDEMCNT(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+	}()
+
+	ac.TpLogInfo("Got UBF: [%v]", ub)
+
+	if mode, _ := ub.BGetString(u.T_STRING_FLD, 0); "SLOW" == mode {
+		time.Sleep(3000 * time.Millisecond)
+	}
+
+	idemCalls++
+	ub.BChg(u.T_LONG_FLD, 0, idemCalls)
+
+	return
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Post the request buffer as SSEEVT event, streamed by restincl sse route
+//@param ac ATMI Context
+//@param svc Service call information
+func SSEPOST(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	ac.TpLogInfo("Got UBF: [%v]", ub)
+
+	if _, err := ac.TpPost("SSEEVT", ub, 0, 0); nil != err {
+		ac.TpLogError("Failed to post SSEEVT: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	return
+}
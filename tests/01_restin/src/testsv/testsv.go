@@ -313,6 +313,13 @@ func LONGOP2(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 func Init(ac *atmi.ATMICtx) int {
 
 	ac.TpLogWarn("Doing server init...")
+
+	//Join global transactions of the callers (TXENQ)
+	if err := ac.TpOpen(); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	//Advertize TESTSVC
 	if err := ac.TpAdvertise("DATASV1", "DATASV1", DATASV1); err != nil {
 		fmt.Println(err)
@@ -439,6 +446,36 @@ func Init(ac *atmi.ATMICtx) int {
 		return atmi.FAIL
 	}
 
+	if err := ac.TpAdvertise("WSPUSH", "WSPUSH", WSPUSH); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("SSEPOST", "SSEPOST", SSEPOST); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("CONVDL", "CONVDL", CONVDL); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("CONVUP", "CONVUP", CONVUP); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("IDEMCNT", "IDEMCNT", IDEMCNT); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("CACHECNT", "CACHECNT", CACHECNT); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	if err := ac.TpAdvertise("UPLDERR", "UPLDERR", UPLDERR); err != nil {
 		fmt.Println(err)
 		return atmi.FAIL
@@ -454,6 +491,11 @@ func Init(ac *atmi.ATMICtx) int {
 		return atmi.FAIL
 	}
 
+	if err := ac.TpAdvertise("TXENQ", "TXENQ", TXENQ); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	return atmi.SUCCEED
 }
 
@@ -461,6 +503,7 @@ func Init(ac *atmi.ATMICtx) int {
 //@param ac ATMI Context
 func Uninit(ac *atmi.ATMICtx) {
 	ac.TpLogWarn("Server is shutting down...")
+	ac.TpClose()
 }
 
 //Executable main entry point
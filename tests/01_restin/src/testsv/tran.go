@@ -0,0 +1,70 @@
+package main
+
+import (
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Enqueue message to SAMPLESPACE/TXQ in the caller's global transaction, for
+//transaction tests. Query parameter "id" gives the correlation id and message
+//T_STRING_FLD, parameter "fail" makes the service to fail after the enqueue
+//@param ac ATMI Context
+//@param svc Service call information
+func TXENQ(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := atmi.TPSUCCESS
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		ac.TpReturn(ret, 0, ub, 0)
+	}()
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (TXENQ):")
+
+	id := ""
+	fail := false
+	occs, _ := ub.BOccur(u.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+		switch nam, _ := ub.BGetString(u.EX_IF_REQQUERYN, i); nam {
+		case "id":
+			id, _ = ub.BGetString(u.EX_IF_REQQUERYV, i)
+		case "fail":
+			fail = true
+		}
+	}
+
+	msg, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		ac.TpLogError("Failed to allocate message: %s", errA.Message())
+		ret = atmi.TPFAIL
+		return
+	}
+
+	msg.BChg(u.T_STRING_FLD, 0, id)
+
+	var ctl atmi.TPQCTL
+	copy(ctl.Corrid[:], id)
+	ctl.Flags = atmi.TPQCORRID
+
+	if errA = ac.TpEnqueue("SAMPLESPACE", "TXQ", &ctl, msg, 0); nil != errA {
+		ac.TpLogError("Failed to enqueue: %s", errA.Message())
+		ret = atmi.TPFAIL
+		return
+	}
+
+	if fail {
+		ac.TpLogWarn("Failing after enqueue, transaction shall be aborted")
+		ret = atmi.TPFAIL
+		return
+	}
+
+	ub.BChg(u.EX_IF_RSPDATA, 0, []byte("enqueued"))
+
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//WebSocket push service, replies to the caller and posts the buffer
+//as event, which restincl delivers to the connection in EX_NETCONNID
+//@param ac ATMI Context
+//@param svc Service call information
+func WSPUSH(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	ac.TpLogInfo("Got UBF: [%v]", ub)
+
+	push, err := ac.NewUBF(1024)
+
+	if nil != err {
+		ac.TpLogError("Failed to alloc UBF: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	connid, _ := ub.BGetInt64(u.EX_NETCONNID, 0)
+	push.BChg(u.EX_NETCONNID, 0, connid)
+	push.BChg(u.T_STRING_FLD, 0, "PUSHED")
+
+	if _, err := ac.TpPost("WSPUSH", push, 0, 0); nil != err {
+		ac.TpLogError("Failed to post WSPUSH: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	return
+}
@@ -0,0 +1,146 @@
+package main
+
+//WebSocket test client: sends one text message and prints the messages
+//received, one per line.
+//Usage: wscl <host:port> <path> <message> <number of messages to receive>
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Write masked text frame
+func writeText(conn net.Conn, msg []byte) error {
+
+	var hdr []byte
+	var mask [4]byte
+
+	rand.Read(mask[:])
+
+	switch l := len(msg); {
+	case l < 126:
+		hdr = []byte{0x81, 0x80 | byte(l)}
+	case l <= 0xffff:
+		hdr = []byte{0x81, 0x80 | 126, 0, 0}
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+	default:
+		hdr = []byte{0x81, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+	}
+
+	data := make([]byte, len(msg))
+	for i := range msg {
+		data[i] = msg[i] ^ mask[i%4]
+	}
+
+	if _, err := conn.Write(append(append(hdr, mask[:]...), data...)); nil != err {
+		return err
+	}
+
+	return nil
+}
+
+//Read frame (server frames are not masked)
+func readFrame(rd *bufio.Reader) (byte, []byte, error) {
+
+	var hdr [8]byte
+
+	if _, err := io.ReadFull(rd, hdr[:2]); nil != err {
+		return 0, nil, err
+	}
+
+	op := hdr[0] & 0x0f
+	l := uint64(hdr[1] & 0x7f)
+
+	switch l {
+	case 126:
+		io.ReadFull(rd, hdr[:2])
+		l = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		io.ReadFull(rd, hdr[:8])
+		l = binary.BigEndian.Uint64(hdr[:8])
+	}
+
+	payload := make([]byte, l)
+	_, err := io.ReadFull(rd, payload)
+
+	return op, payload, err
+}
+
+func main() {
+
+	if len(os.Args) < 5 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <host:port> <path> <message> <count>\n",
+			os.Args[0])
+		os.Exit(1)
+	}
+
+	count, _ := strconv.Atoi(os.Args[4])
+
+	conn, err := net.Dial("tcp", os.Args[1])
+
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %s\n", err)
+		os.Exit(1)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var key [16]byte
+	rand.Read(key[:])
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: %s\r\n\r\n", os.Args[2], os.Args[1],
+		base64.StdEncoding.EncodeToString(key[:]))
+
+	rd := bufio.NewReader(conn)
+
+	status, _ := rd.ReadString('\n')
+
+	if !strings.Contains(status, " 101 ") {
+		fmt.Fprintf(os.Stderr, "Upgrade failed: %s\n", status)
+		os.Exit(1)
+	}
+
+	//Skip headers
+	for {
+		line, err := rd.ReadString('\n')
+		if nil != err || "\r\n" == line {
+			break
+		}
+	}
+
+	if err = writeText(conn, []byte(os.Args[3])); nil != err {
+		fmt.Fprintf(os.Stderr, "Failed to send: %s\n", err)
+		os.Exit(1)
+	}
+
+	for i := 0; i < count; {
+
+		op, payload, err := readFrame(rd)
+
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Failed to read: %s\n", err)
+			os.Exit(1)
+		}
+
+		if 0x1 == op {
+			fmt.Println(string(payload))
+			i++
+		} else if 0x8 == op {
+			fmt.Fprintf(os.Stderr, "Connection closed by server\n")
+			os.Exit(1)
+		}
+	}
+}